@@ -0,0 +1,42 @@
+package featureprobe
+
+import "time"
+
+// Clock tells the current time, FPConfig.Clock replaces the system clock for
+// datetime conditions, the debug window and event timestamps.
+type Clock interface {
+	Now() time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+// EvalOption customizes a single evaluation.
+type EvalOption func(*evalOptions)
+
+type evalOptions struct {
+	asOf time.Time
+}
+
+// AsOf evaluates datetime conditions as of t instead of the current time.
+// Events are still timestamped and matched against the debug window with the
+// current time.
+func AsOf(t time.Time) EvalOption {
+	return func(o *evalOptions) {
+		o.asOf = t
+	}
+}
+
+func (fp *FeatureProbe) now() time.Time {
+	if fp.Config.Clock == nil {
+		return time.Now()
+	}
+	return fp.Config.Clock.Now()
+}
+
+func unixMilli(t time.Time) int64 {
+	return t.UnixNano() / 1e6
+}
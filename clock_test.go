@@ -0,0 +1,92 @@
+package featureprobe
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type fixedClock struct {
+	now time.Time
+}
+
+func (c *fixedClock) Now() time.Time {
+	return c.now
+}
+
+var launchTime = time.Date(2023, 11, 14, 12, 0, 0, 0, time.UTC)
+
+func setupScheduledToggle(clock Clock) *FeatureProbe {
+	on, off := 0, 1
+	repo := &Repository{}
+	repo.flush(RepositoryData{
+		Toggles: map[string]Toggle{
+			"scheduled_toggle": {
+				Key:           "scheduled_toggle",
+				Enabled:       true,
+				Version:       1,
+				DisabledServe: Serve{Select: &off},
+				DefaultServe:  Serve{Select: &off},
+				Rules: []Rule{{
+					Serve: Serve{Select: &on},
+					Conditions: []Condition{{
+						Type:      "datetime",
+						Predicate: "after",
+						Objects:   []string{launchTime.Format(time.RFC3339)},
+					}},
+				}},
+				Variations: []interface{}{true, false},
+			},
+		},
+		DebugUntilTime: uint64(unixMilli(launchTime)),
+	})
+	recorder := NewEventRecorder("http://localhost/", time.Second, "")
+	recorder.clock = clock
+	return &FeatureProbe{Repo: repo, Recorder: recorder, Config: FPConfig{MaxPrerequisitesDeep: 5, Clock: clock}}
+}
+
+func TestClockDatetimeCondition(t *testing.T) {
+	clock := &fixedClock{now: launchTime.Add(-time.Second)}
+	fp := setupScheduledToggle(clock)
+	user := NewUser().StableRollout("user")
+
+	assert.False(t, fp.BoolValue("scheduled_toggle", user, true))
+	clock.now = launchTime
+	assert.True(t, fp.BoolValue("scheduled_toggle", user, false))
+}
+
+func TestEvaluateAsOf(t *testing.T) {
+	clock := &fixedClock{now: launchTime}
+	fp := setupScheduledToggle(clock)
+	user := NewUser().StableRollout("user")
+
+	detail := fp.BoolDetail("scheduled_toggle", user, true, AsOf(launchTime.Add(-time.Hour)))
+	assert.False(t, detail.Value)
+	assert.Equal(t, "default", detail.Reason)
+	assert.True(t, fp.BoolValue("scheduled_toggle", user, false, AsOf(launchTime.Add(time.Hour))))
+	assert.True(t, fp.BoolValue("scheduled_toggle", user, false))
+}
+
+func TestClockEvents(t *testing.T) {
+	clock := &fixedClock{now: launchTime}
+	fp := setupScheduledToggle(clock)
+	user := NewUser().StableRollout("user")
+
+	fp.BoolValue("scheduled_toggle", user, false)
+	fp.Track("some_event", user, nil)
+	assert.Equal(t, 2, len(fp.Recorder.incomingEvents))
+	debugEvent := fp.Recorder.incomingEvents[0].(DebugEvent)
+	assert.Equal(t, unixMilli(launchTime), debugEvent.Time)
+	customEvent := fp.Recorder.incomingEvents[1].(CustomEvent)
+	assert.Equal(t, unixMilli(launchTime), customEvent.Time)
+	assert.Equal(t, unixMilli(launchTime), fp.Recorder.access.StartTime)
+
+	// the debug window is over
+	clock.now = launchTime.Add(time.Millisecond)
+	fp.BoolValue("scheduled_toggle", user, false)
+	assert.Equal(t, 2, len(fp.Recorder.incomingEvents))
+
+	packed := fp.Recorder.buildPackedData(nil)
+	assert.Equal(t, unixMilli(clock.now), packed[0].Access.EndTime)
+}
@@ -0,0 +1,144 @@
+package featureprobe
+
+import (
+	"net/netip"
+	"regexp"
+	"strconv"
+
+	"github.com/Masterminds/semver/v3"
+)
+
+// compiledCondition holds the objects of a Condition parsed ahead of
+// evaluation. Parsed lists stop at the first object that fails to parse,
+// since evaluation never looks past it.
+type compiledCondition struct {
+	objectSet map[string]struct{}
+	regexps   []*regexp.Regexp
+	numbers   []float64
+	datetime  *datetimeObjects
+	versions  []*semver.Version
+	prefixes  []netip.Prefix
+	// constraints are the ranges of "satisfies" semver conditions.
+	constraints []*semver.Constraints
+	// objects are the objects of string and list conditions normalized by
+	// normalizeString, nil when the condition doesn't normalize strings.
+	objects []string
+	// malformed is the error of a condition that can't be evaluated.
+	malformed error
+}
+
+func compileCondition(c Condition) *compiledCondition {
+	compiled := &compiledCondition{malformed: malformedCondition(c)}
+	switch c.Type {
+	case "string", "list":
+		objects := c.stringObjects()
+		if c.IgnoreCase || c.Normalize {
+			compiled.objects = objects
+		}
+		compiled.objectSet = make(map[string]struct{}, len(objects))
+		for _, o := range objects {
+			compiled.objectSet[o] = struct{}{}
+		}
+		if c.Predicate == "matches regex" || c.Predicate == "does not match regex" {
+			compiled.regexps = make([]*regexp.Regexp, 0, len(c.Objects))
+			for _, o := range c.Objects {
+				// an invalid regex never matches, keep nil in its place
+				r, _ := regexp.Compile(c.regexPattern(o))
+				compiled.regexps = append(compiled.regexps, r)
+			}
+		}
+	case "number":
+		for _, o := range c.Objects {
+			n, err := strconv.ParseFloat(o, 32)
+			if err != nil {
+				break
+			}
+			compiled.numbers = append(compiled.numbers, n)
+		}
+	case "datetime":
+		compiled.datetime = parseDatetimeObjects(c)
+	case "ip":
+		compiled.prefixes = parseIpPrefixes(c.Objects)
+	case "semver":
+		if c.Predicate == "satisfies" || c.Predicate == "does not satisfy" {
+			compiled.constraints = c.parseSemverConstraints()
+			break
+		}
+		for _, o := range c.Objects {
+			v, err := c.parseVersion(o)
+			if err != nil {
+				break
+			}
+			compiled.versions = append(compiled.versions, v)
+		}
+	}
+	return compiled
+}
+
+// compileRules returns a copy of rules with compiled conditions, the given
+// rules may be in use by concurrent evaluations and are left untouched.
+func compileRules(rules []Rule) []Rule {
+	if rules == nil {
+		return nil
+	}
+	compiled := make([]Rule, len(rules))
+	for i, rule := range rules {
+		conditions := make([]Condition, len(rule.Conditions))
+		for j, condition := range rule.Conditions {
+			condition.compiled = compileCondition(condition)
+			conditions[j] = condition
+		}
+		rule.Conditions = conditions
+		compiled[i] = rule
+	}
+	return compiled
+}
+
+// compileTargets returns a copy of targets with their key sets built.
+func compileTargets(targets []Target) []Target {
+	if targets == nil {
+		return nil
+	}
+	compiled := make([]Target, len(targets))
+	for i, target := range targets {
+		target.keySet = newKeySet(target.Keys)
+		compiled[i] = target
+	}
+	return compiled
+}
+
+// compileRepositoryData compiles the toggles and segments of data, reusing
+// the compiled toggles and segments of previous whose version is unchanged.
+func compileRepositoryData(data RepositoryData, previousToggles map[string]Toggle,
+	previousSegments map[string]Segment) RepositoryData {
+	if data.Toggles != nil {
+		toggles := make(map[string]Toggle, len(data.Toggles))
+		for key, toggle := range data.Toggles {
+			if old, ok := previousToggles[key]; ok && old.compiled && old.Version == toggle.Version {
+				toggles[key] = old
+				continue
+			}
+			toggle.Rules = compileRules(toggle.Rules)
+			toggle.Targets = compileTargets(toggle.Targets)
+			toggle.compiled = true
+			toggles[key] = toggle
+		}
+		data.Toggles = toggles
+	}
+	if data.Segments != nil {
+		segments := make(map[string]Segment, len(data.Segments))
+		for key, segment := range data.Segments {
+			if old, ok := previousSegments[key]; ok && old.compiled && old.Version == segment.Version {
+				segments[key] = old
+				continue
+			}
+			segment.Rules = compileRules(segment.Rules)
+			segment.includedSet = newKeySet(segment.Included)
+			segment.excludedSet = newKeySet(segment.Excluded)
+			segment.compiled = true
+			segments[key] = segment
+		}
+		data.Segments = segments
+	}
+	return data
+}
@@ -0,0 +1,106 @@
+package featureprobe
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var compileTestConditions = []Condition{
+	{Type: "string", Subject: "name", Predicate: "is one of", Objects: []string{"hello", "world"}},
+	{Type: "string", Subject: "name", Predicate: "is not any of", Objects: []string{"hello", "world"}},
+	{Type: "string", Subject: "name", Predicate: "contains", Objects: []string{"ell"}},
+	{Type: "string", Subject: "name", Predicate: "matches regex", Objects: []string{"[invalid", "^h.*o$"}},
+	{Type: "string", Subject: "name", Predicate: "does not match regex", Objects: []string{"^w"}},
+	{Type: "number", Subject: "age", Predicate: ">", Objects: []string{"18", "abc", "1"}},
+	{Type: "number", Subject: "age", Predicate: "=", Objects: []string{"12.5", "20"}},
+	{Type: "number", Subject: "age", Predicate: "!=", Objects: []string{"20"}},
+	{Type: "datetime", Subject: "created", Predicate: "after", Objects: []string{"1600000000"}},
+	{Type: "datetime", Subject: "created", Predicate: "before", Objects: []string{"x", "1700000000"}},
+	{Type: "semver", Subject: "version", Predicate: ">=", Objects: []string{"1.2.0", "2.0.0"}},
+	{Type: "semver", Subject: "version", Predicate: "<", Objects: []string{"invalid", "3.0.0"}},
+	{Type: "semver", Subject: "version", Predicate: "!=", Objects: []string{"1.2.3"}},
+}
+
+var compileTestUsers = []FPUser{
+	NewUser(),
+	NewUser().With("name", "hello").With("age", "20").With("created", "1650000000").With("version", "1.2.3"),
+	NewUser().With("name", "world").With("age", "12.5").With("created", "1500000000").With("version", "2.1.0"),
+	NewUser().With("name", "howdy").With("age", "abc").With("created", "abc").With("version", "abc"),
+}
+
+func TestCompiledConditionsMatchRaw(t *testing.T) {
+	for _, condition := range compileTestConditions {
+		compiled := condition
+		compiled.compiled = compileCondition(condition)
+		for _, user := range compileTestUsers {
+			assert.Equal(t, condition.meet(user, nil), compiled.meet(user, nil),
+				"%s %s %v for %v", condition.Type, condition.Predicate, condition.Objects, user.GetAll())
+		}
+	}
+}
+
+func TestCompiledRepositoryEvalMatchRaw(t *testing.T) {
+	repo, _ := loadRepoFromFile()
+	bytes, _ := ioutil.ReadFile("./resources/fixtures/repo.json")
+	raw := RepositoryData{}
+	_ = json.Unmarshal(bytes, &raw)
+	markPrerequisiteCycles(raw)
+
+	users := []FPUser{
+		NewUser().StableRollout("key11").With("city", "4"),
+		NewUser().StableRollout("key").With("city", "1").With("os", "linux"),
+		NewUser().StableRollout("key2").With("city", "100"),
+	}
+	for key, toggle := range repo.getToggles() {
+		rawToggle := raw.Toggles[key]
+		assert.True(t, toggle.compiled)
+		assert.False(t, rawToggle.compiled)
+		for _, user := range users {
+			compiledDetail, _ := toggle.evalDetail(user, repo.getToggles(), repo.getSegments(), nil, 10)
+			rawDetail, _ := rawToggle.evalDetail(user, raw.Toggles, raw.Segments, nil, 10)
+			assert.Equal(t, rawDetail, compiledDetail, key)
+		}
+	}
+}
+
+func TestCompileReusesUnchangedVersion(t *testing.T) {
+	repo, _ := loadRepoFromFile()
+	before, _ := repo.getToggle("multi_condition_toggle")
+	repo.flush(RepositoryData{Toggles: repo.getToggles(), Segments: repo.getSegments()})
+	after, _ := repo.getToggle("multi_condition_toggle")
+	assert.True(t, before.Rules[0].Conditions[0].compiled == after.Rules[0].Conditions[0].compiled)
+
+	changed := after
+	changed.Version++
+	repo.flush(RepositoryData{Toggles: map[string]Toggle{changed.Key: changed}})
+	recompiled, _ := repo.getToggle("multi_condition_toggle")
+	assert.False(t, after.Rules[0].Conditions[0].compiled == recompiled.Rules[0].Conditions[0].compiled)
+}
+
+func benchmarkConditions(b *testing.B, compile bool) {
+	conditions := make([]Condition, len(compileTestConditions))
+	for i, condition := range compileTestConditions {
+		if compile {
+			condition.compiled = compileCondition(condition)
+		}
+		conditions[i] = condition
+	}
+	user := compileTestUsers[1]
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for j := range conditions {
+			conditions[j].meet(user, nil)
+		}
+	}
+}
+
+func BenchmarkRawConditions(b *testing.B) {
+	benchmarkConditions(b, false)
+}
+
+func BenchmarkCompiledConditions(b *testing.B) {
+	benchmarkConditions(b, true)
+}
@@ -0,0 +1,175 @@
+package featureprobe
+
+import (
+	"fmt"
+	"sync"
+)
+
+// DataStore is an external storage of toggles and segments, usually shared by
+// many SDK instances. A relay process polling the FeatureProbe server writes
+// into it, and instances running in daemon mode only read from it.
+type DataStore interface {
+	// Init replaces all the toggles, segments and the debug until time in the
+	// store.
+	Init(data RepositoryData) error
+	// GetToggle returns the toggle of key, ok is false if it does not exist.
+	GetToggle(key string) (toggle Toggle, ok bool, err error)
+	// GetToggles returns all the toggles keyed by toggle key.
+	GetToggles() (map[string]Toggle, error)
+	// GetSegments returns all the segments keyed by segment unique id.
+	GetSegments() (map[string]Segment, error)
+	// GetDebugUntilTime returns the debug until time stored by Init.
+	GetDebugUntilTime() (uint64, error)
+	// Upsert stores toggle unless a toggle with a newer version is stored.
+	Upsert(toggle Toggle) error
+	// Delete removes the toggle of key.
+	Delete(key string) error
+	// Version increases every time Init, Upsert or Delete changes the store,
+	// whichever instance called them.
+	Version() (uint64, error)
+}
+
+// loadDataStore reads all the data kept in store.
+func loadDataStore(store DataStore) (RepositoryData, error) {
+	toggles, err := store.GetToggles()
+	if err != nil {
+		return RepositoryData{}, err
+	}
+	segments, err := store.GetSegments()
+	if err != nil {
+		return RepositoryData{}, err
+	}
+	debugUntilTime, err := store.GetDebugUntilTime()
+	if err != nil {
+		return RepositoryData{}, err
+	}
+	return RepositoryData{Toggles: toggles, Segments: segments, DebugUntilTime: debugUntilTime}, nil
+}
+
+// dataStoreVersions identifies the content of RepositoryData by the versions
+// of its toggles and segments.
+type dataStoreVersions struct {
+	toggles        map[string]uint64
+	segments       map[string]uint64
+	debugUntilTime uint64
+}
+
+func newDataStoreVersions(data RepositoryData) *dataStoreVersions {
+	versions := &dataStoreVersions{
+		toggles:        make(map[string]uint64, len(data.Toggles)),
+		segments:       make(map[string]uint64, len(data.Segments)),
+		debugUntilTime: data.DebugUntilTime,
+	}
+	for key, toggle := range data.Toggles {
+		versions.toggles[key] = toggle.Version
+	}
+	for key, segment := range data.Segments {
+		versions.segments[key] = segment.Version
+	}
+	return versions
+}
+
+func (v *dataStoreVersions) equal(other *dataStoreVersions) bool {
+	if v == nil || other == nil || v.debugUntilTime != other.debugUntilTime {
+		return false
+	}
+	return equalVersions(v.toggles, other.toggles) && equalVersions(v.segments, other.segments)
+}
+
+func equalVersions(a, b map[string]uint64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for key, version := range a {
+		if other, ok := b[key]; !ok || other != version {
+			return false
+		}
+	}
+	return true
+}
+
+// dataStoreAdapter exposes a DataStore as a ToggleStore for the instance
+// writing into it. Changes are written through to the store, and reads are
+// answered from an in-memory snapshot of the data so evaluations never wait
+// on the store. Applying the data already stored is skipped, so polls that
+// find nothing new don't change the store version. Write errors are logged.
+type dataStoreAdapter struct {
+	store  DataStore
+	memory MemoryStore
+	mu     sync.Mutex
+	// versions of the data in the store and in memory, nil when unknown
+	stored  *dataStoreVersions
+	applied *dataStoreVersions
+}
+
+// newDataStoreRepository creates a repository writing through to store. It
+// starts from the data already in store, so toggles can be evaluated before
+// the first sync with the FeatureProbe server.
+func newDataStoreRepository(store DataStore) *Repository {
+	adapter := &dataStoreAdapter{store: store}
+	repo := NewRepository(adapter)
+	data, err := loadDataStore(store)
+	if err != nil {
+		fmt.Printf("data store load err: %s\n", err)
+		return repo
+	}
+	// flush only fills the snapshot, the store already holds data
+	adapter.stored = newDataStoreVersions(data)
+	repo.flush(data)
+	return repo
+}
+
+func (d *dataStoreAdapter) Get(key string) (Toggle, bool) {
+	return d.memory.Get(key)
+}
+
+func (d *dataStoreAdapter) All() map[string]Toggle {
+	return d.memory.All()
+}
+
+func (d *dataStoreAdapter) Segments() map[string]Segment {
+	return d.memory.Segments()
+}
+
+func (d *dataStoreAdapter) Apply(data RepositoryData) {
+	versions := newDataStoreVersions(data)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if !versions.equal(d.stored) {
+		d.stored = nil
+		if err := d.store.Init(data); err != nil {
+			fmt.Printf("data store init err: %s\n", err)
+		} else {
+			d.stored = versions
+		}
+	}
+	if !versions.equal(d.applied) {
+		d.memory.Apply(data)
+		d.applied = versions
+	}
+}
+
+func (d *dataStoreAdapter) Upsert(toggle Toggle) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.stored, d.applied = nil, nil
+	if err := d.store.Upsert(toggle); err != nil {
+		fmt.Printf("data store upsert err: %s\n", err)
+	}
+	d.memory.Upsert(toggle)
+}
+
+func (d *dataStoreAdapter) Delete(key string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.stored, d.applied = nil, nil
+	if err := d.store.Delete(key); err != nil {
+		fmt.Printf("data store delete err: %s\n", err)
+	}
+	d.memory.Delete(key)
+}
+
+// Version increases every time the snapshot changes.
+func (d *dataStoreAdapter) Version() uint64 {
+	return d.memory.Version()
+}
@@ -0,0 +1,165 @@
+package featureprobe
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// millisecondsThreshold tells timestamps in seconds from timestamps in
+// milliseconds: it is in year 5138 as seconds and in 1973 as milliseconds.
+const millisecondsThreshold = 100000000000
+
+// datetimeObjects holds the objects of a datetime condition parsed according
+// to its predicate. Like other parsed objects, lists stop at the first object
+// that fails to parse.
+type datetimeObjects struct {
+	// datetimes are the objects of "after" and "before", and the [start, end)
+	// pairs of "between".
+	datetimes []time.Time
+	weekdays  map[time.Weekday]bool
+	// clocks are the [start, end) pairs of "between times of day", in seconds
+	// since midnight.
+	clocks []int
+	// location is the condition time zone, nil when unknown.
+	location *time.Location
+}
+
+// parseDatetime parses a timestamp in seconds or milliseconds, or a RFC 3339
+// datetime.
+func parseDatetime(s string) (time.Time, error) {
+	if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return timestampTime(n), nil
+	}
+	return time.Parse(time.RFC3339Nano, s)
+}
+
+func timestampTime(n int64) time.Time {
+	if n >= millisecondsThreshold || n <= -millisecondsThreshold {
+		return time.Unix(n/1000, n%1000*int64(time.Millisecond))
+	}
+	return time.Unix(n, 0)
+}
+
+var weekdayNames = map[string]time.Weekday{}
+
+func init() {
+	for d := time.Sunday; d <= time.Saturday; d++ {
+		name := strings.ToLower(d.String())
+		weekdayNames[name] = d
+		weekdayNames[name[:3]] = d
+	}
+}
+
+// parseWeekday parses a day of week name, like "monday" or "mon".
+func parseWeekday(s string) (time.Weekday, error) {
+	if d, ok := weekdayNames[strings.ToLower(s)]; ok {
+		return d, nil
+	}
+	return time.Sunday, fmt.Errorf("unknown day of week %q", s)
+}
+
+// parseClock parses a time of day as "15:04" or "15:04:05", into seconds since
+// midnight. "24:00" is the end of the day.
+func parseClock(s string) (int, error) {
+	if s == "24:00" {
+		return 24 * 60 * 60, nil
+	}
+	layout := "15:04"
+	if strings.Count(s, ":") == 2 {
+		layout = "15:04:05"
+	}
+	t, err := time.Parse(layout, s)
+	if err != nil {
+		return 0, err
+	}
+	return t.Hour()*60*60 + t.Minute()*60 + t.Second(), nil
+}
+
+func loadLocation(timezone string) (*time.Location, error) {
+	if timezone == "" {
+		return time.UTC, nil
+	}
+	return time.LoadLocation(timezone)
+}
+
+func parseDatetimeObjects(c Condition) *datetimeObjects {
+	objects := &datetimeObjects{}
+	objects.location, _ = loadLocation(c.Timezone)
+	switch c.Predicate {
+	case "on days of week":
+		objects.weekdays = make(map[time.Weekday]bool, len(c.Objects))
+		for _, o := range c.Objects {
+			d, err := parseWeekday(o)
+			if err != nil {
+				break
+			}
+			objects.weekdays[d] = true
+		}
+	case "between times of day":
+		for _, o := range c.Objects {
+			s, err := parseClock(o)
+			if err != nil {
+				break
+			}
+			objects.clocks = append(objects.clocks, s)
+		}
+	default:
+		for _, o := range c.Objects {
+			d, err := parseDatetime(o)
+			if err != nil {
+				break
+			}
+			objects.datetimes = append(objects.datetimes, d)
+		}
+	}
+	return objects
+}
+
+// match tells whether t matches the predicate. Ranges are given by pairs of
+// objects including their start and excluding their end, a time of day range
+// whose start is after its end spans midnight.
+func (o *datetimeObjects) match(t time.Time, predicate string) bool {
+	switch predicate {
+	case "after":
+		for _, d := range o.datetimes {
+			if !t.Before(d) {
+				return true
+			}
+		}
+	case "before":
+		for _, d := range o.datetimes {
+			if t.Before(d) {
+				return true
+			}
+		}
+	case "between":
+		for i := 0; i+1 < len(o.datetimes); i += 2 {
+			if !t.Before(o.datetimes[i]) && t.Before(o.datetimes[i+1]) {
+				return true
+			}
+		}
+	case "on days of week":
+		if o.location == nil {
+			return false
+		}
+		return o.weekdays[t.In(o.location).Weekday()]
+	case "between times of day":
+		if o.location == nil {
+			return false
+		}
+		local := t.In(o.location)
+		clock := local.Hour()*60*60 + local.Minute()*60 + local.Second()
+		for i := 0; i+1 < len(o.clocks); i += 2 {
+			start, end := o.clocks[i], o.clocks[i+1]
+			if start <= end && clock >= start && clock < end {
+				return true
+			}
+			if start > end && (clock >= start || clock < end) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,154 @@
+package featureprobe
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseDatetime(t *testing.T) {
+	d, err := parseDatetime("1700000000")
+	assert.Nil(t, err)
+	assert.Equal(t, time.Unix(1700000000, 0), d)
+
+	d, err = parseDatetime("1700000000123")
+	assert.Nil(t, err)
+	assert.Equal(t, time.Unix(1700000000, 123*int64(time.Millisecond)), d)
+
+	d, err = parseDatetime("2023-11-14T22:13:20Z")
+	assert.Nil(t, err)
+	assert.True(t, time.Unix(1700000000, 0).Equal(d))
+
+	d, err = parseDatetime("2023-11-14T23:13:20.5+01:00")
+	assert.Nil(t, err)
+	assert.True(t, time.Unix(1700000000, 500*int64(time.Millisecond)).Equal(d))
+
+	_, err = parseDatetime("2023-11-14 22:13:20")
+	assert.NotNil(t, err)
+}
+
+func TestDatetimeRfc3339AndMilliseconds(t *testing.T) {
+	condition := Condition{
+		Type:      "datetime",
+		Subject:   "created",
+		Predicate: "after",
+		Objects:   []string{"2023-11-14T22:13:20Z"},
+	}
+
+	user := NewUser().With("created", "1700000000000")
+	assert.True(t, condition.meet(user, nil))
+
+	user = NewUser().With("created", "1699999999999")
+	assert.False(t, condition.meet(user, nil))
+
+	user = NewUser().With("created", "2023-11-14T23:13:20+01:00")
+	assert.True(t, condition.meet(user, nil))
+
+	user = NewUser().WithNumber("created", 1699999999)
+	assert.False(t, condition.meet(user, nil))
+
+	user = NewUser().With("created", "yesterday")
+	assert.False(t, condition.meet(user, nil))
+}
+
+func TestDatetimeBetween(t *testing.T) {
+	condition := Condition{
+		Type:      "datetime",
+		Subject:   "created",
+		Predicate: "between",
+		Objects:   []string{"1000", "2000", "2023-01-01T00:00:00Z", "2024-01-01T00:00:00Z"},
+	}
+
+	assert.True(t, condition.meet(NewUser().With("created", "1000"), nil))
+	assert.True(t, condition.meet(NewUser().With("created", "1999"), nil))
+	assert.False(t, condition.meet(NewUser().With("created", "2000"), nil))
+	assert.True(t, condition.meet(NewUser().With("created", "2023-06-01T00:00:00Z"), nil))
+	assert.False(t, condition.meet(NewUser().With("created", "2024-01-01T00:00:00Z"), nil))
+
+	condition.Objects = []string{"1000"}
+	assert.False(t, condition.meet(NewUser().With("created", "1500"), nil))
+}
+
+func TestDatetimeDaysOfWeek(t *testing.T) {
+	condition := Condition{
+		Type:      "datetime",
+		Subject:   "now",
+		Predicate: "on days of week",
+		Objects:   []string{"Monday", "tue"},
+		Timezone:  "Europe/Berlin",
+	}
+
+	// Sunday 23:30 UTC is Monday 00:30 in Berlin
+	user := NewUser().With("now", "2023-11-12T23:30:00Z")
+	assert.True(t, condition.meet(user, nil))
+
+	user = NewUser().With("now", "2023-11-12T22:30:00Z")
+	assert.False(t, condition.meet(user, nil))
+
+	condition.Timezone = ""
+	user = NewUser().With("now", "2023-11-12T23:30:00Z")
+	assert.False(t, condition.meet(user, nil))
+
+	condition.Timezone = "Mars/Olympus"
+	user = NewUser().With("now", "2023-11-13T12:00:00Z")
+	assert.False(t, condition.meet(user, nil))
+}
+
+func TestDatetimeTimesOfDay(t *testing.T) {
+	condition := Condition{
+		Type:      "datetime",
+		Subject:   "now",
+		Predicate: "between times of day",
+		Objects:   []string{"09:00", "17:30"},
+		Timezone:  "Europe/Berlin",
+	}
+
+	assert.True(t, condition.meet(NewUser().With("now", "2023-11-13T08:00:00Z"), nil))
+	assert.False(t, condition.meet(NewUser().With("now", "2023-11-13T07:59:59Z"), nil))
+	assert.True(t, condition.meet(NewUser().With("now", "2023-11-13T16:29:59Z"), nil))
+	assert.False(t, condition.meet(NewUser().With("now", "2023-11-13T16:30:00Z"), nil))
+
+	// a range spanning midnight
+	condition.Objects = []string{"22:00", "06:00:30"}
+	assert.True(t, condition.meet(NewUser().With("now", "2023-11-13T22:00:00Z"), nil))
+	assert.True(t, condition.meet(NewUser().With("now", "2023-11-13T05:00:29Z"), nil))
+	assert.False(t, condition.meet(NewUser().With("now", "2023-11-13T05:00:30Z"), nil))
+	assert.False(t, condition.meet(NewUser().With("now", "2023-11-13T12:00:00Z"), nil))
+}
+
+func TestCompiledDatetimeSchedule(t *testing.T) {
+	condition := Condition{
+		Type:      "datetime",
+		Subject:   "now",
+		Predicate: "between times of day",
+		Objects:   []string{"09:00", "17:30"},
+		Timezone:  "Europe/Berlin",
+	}
+	compiled := condition
+	compiled.compiled = compileCondition(condition)
+
+	for _, now := range []string{"2023-11-13T07:59:59Z", "2023-11-13T08:00:00Z", "2023-11-13T16:30:00Z"} {
+		user := NewUser().With("now", now)
+		assert.Equal(t, condition.meet(user, nil), compiled.meet(user, nil))
+	}
+}
+
+func TestValidateDatetimeCondition(t *testing.T) {
+	problems := validateCondition(Condition{Type: "datetime", Predicate: "between",
+		Objects: []string{"2023-11-14T22:13:20Z", "soon", "1000"}}, RepositoryData{})
+	assert.Equal(t, 2, len(problems))
+	assert.Equal(t, ".objects", problems[0].Path)
+	assert.Equal(t, ".objects[1]", problems[1].Path)
+
+	problems = validateCondition(Condition{Type: "datetime", Predicate: "on days of week",
+		Objects: []string{"mon", "someday"}, Timezone: "Mars/Olympus"}, RepositoryData{})
+	assert.Equal(t, 2, len(problems))
+	assert.Equal(t, ".timezone", problems[0].Path)
+	assert.Equal(t, ".objects[1]", problems[1].Path)
+
+	problems = validateCondition(Condition{Type: "datetime", Predicate: "between times of day",
+		Objects: []string{"09:00", "25:00"}, Timezone: "Europe/Berlin"}, RepositoryData{})
+	assert.Equal(t, 1, len(problems))
+	assert.Equal(t, ".objects[1]", problems[0].Path)
+}
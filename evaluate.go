@@ -6,19 +6,25 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"net/netip"
 	"regexp"
 	"strconv"
 	"strings"
 	"sync/atomic"
 	"time"
 
-	"github.com/masterminds/semver"
+	"github.com/Masterminds/semver/v3"
+	"golang.org/x/text/cases"
+	"golang.org/x/text/unicode/norm"
 )
 
+// Repository is the source of toggles for evaluation, the zero value keeps
+// them in a MemoryStore.
 type Repository struct {
-	toggles        atomic.Value
-	segments       atomic.Value
+	memory         MemoryStore
+	store          ToggleStore
 	debugUntilTime atomic.Uint64
+	report         atomic.Value
 }
 
 type RepositoryData struct {
@@ -44,13 +50,34 @@ type Toggle struct {
 	Rules             []Rule         `json:"rules"`
 	Variations        []interface{}  `json:"variations"`
 	Prerequisites     []Prerequisite `json:"prerequisites"`
+	Targets           []Target       `json:"targets,omitempty"`
+	compiled          bool
+	prerequisiteCycle bool
+}
+
+// Target serves Variation to the users whose key is in Keys, it is checked
+// after prerequisites and before rules.
+type Target struct {
+	Variation int      `json:"variation"`
+	Keys      []string `json:"keys"`
+	keySet    map[string]struct{}
 }
 
 type Segment struct {
 	Key     string `json:"key"`
 	UniqId  string `json:"uniqueId"`
 	Version uint64 `json:"version"`
-	Rules   []Rule `json:"rules"`
+	// Included and Excluded list user keys which are in or out of the segment
+	// whatever its rules, exclusion wins when a key is in both.
+	Included    []string `json:"included,omitempty"`
+	Excluded    []string `json:"excluded,omitempty"`
+	includedSet map[string]struct{}
+	excludedSet map[string]struct{}
+	// Unbounded segments look up their users in the SegmentMembershipStore,
+	// by unique id, before evaluating their rules.
+	Unbounded bool   `json:"unbounded,omitempty"`
+	Rules     []Rule `json:"rules"`
+	compiled  bool
 }
 
 type Serve struct {
@@ -67,6 +94,68 @@ type Split struct {
 	Distribution [][]Range `json:"distribution"`
 	BucketBy     string    `json:"bucketBy,omitempty"`
 	Salt         string    `json:"salt,omitempty"`
+	// ExperimentId identifies the experiment the split allocates users to,
+	// the users it serves are in the experiment unless they are held out.
+	ExperimentId string   `json:"experimentId,omitempty"`
+	Holdout      *Holdout `json:"holdout,omitempty"`
+	Layer        *Layer   `json:"layer,omitempty"`
+}
+
+// BucketShare is a share of a bucket space common to the toggles using the
+// same Key: users are hashed with Salt, and those whose bucket is in one of
+// Ranges are in the share. Toggles must use the same Salt with the same Key.
+type BucketShare struct {
+	Key string `json:"key"`
+	// Salt defaults to Key.
+	Salt      string  `json:"salt,omitempty"`
+	Ranges    []Range `json:"ranges"`
+	Variation int     `json:"variation"`
+}
+
+// Holdout keeps a stable share of users out of experiments: users in the
+// share are served Variation. Toggles sharing a holdout hold out the same
+// users.
+type Holdout = BucketShare
+
+// Layer makes the experiments of several toggles mutually exclusive: each
+// toggle of a layer only allocates the users in its share, whose Ranges must
+// not overlap the ranges of the other toggles. The other users are served
+// Variation.
+type Layer = BucketShare
+
+// splitAllocation tells how a split allocated the user.
+type splitAllocation struct {
+	experimentId string
+	inExperiment bool
+	holdout      string
+	layer        string
+	// explanation is nil when the value was not served by a split.
+	explanation *SplitExplanation
+}
+
+// SplitExplanation tells how a split bucketed a user. The bucket of a hash key
+// and a salt is given by Bucket.
+type SplitExplanation struct {
+	// RuleIndex is the rule of the split, nil for the default or disabled serve.
+	RuleIndex *int
+	// HashKey is the user key, or the BucketBy attribute or context key.
+	HashKey  string
+	BucketBy string
+	// Salt is the split salt, or the toggle key when the split has none.
+	Salt        string
+	BucketIndex int
+	// Range is the distribution range BucketIndex is in, and VariationIndex
+	// the variation of that range.
+	Range          Range
+	VariationIndex int
+	// Holdout is set when the user is held out, Salt, BucketIndex and Range
+	// are then those of the holdout.
+	Holdout string
+	// Layer is the experiment layer the user is in through the split. When
+	// OutsideLayer is set the user is in the share of another toggle, Salt
+	// and BucketIndex are then those of the layer.
+	Layer        string
+	OutsideLayer bool
 }
 
 type Range struct {
@@ -79,6 +168,26 @@ type Condition struct {
 	Subject   string   `json:"subject"`
 	Predicate string   `json:"predicate"`
 	Objects   []string `json:"objects"`
+	// Timezone is the IANA time zone of datetime conditions on days of week
+	// and times of day, UTC when empty.
+	Timezone string `json:"timezone,omitempty"`
+	// IgnoreCase compares string and list conditions with Unicode case
+	// folding, and makes regular expressions case-insensitive.
+	IgnoreCase bool `json:"ignoreCase,omitempty"`
+	// Normalize compares string and list conditions in Unicode NFC form.
+	Normalize bool `json:"normalize,omitempty"`
+	// RegexFlags are flags of regular expressions as in Go "(?flags)", i.e.
+	// any of "i", "m", "s" and "U".
+	RegexFlags string `json:"regexFlags,omitempty"`
+	// Prerelease is the policy of semver conditions for prerelease versions:
+	// when empty ranges only match the prereleases of versions they name, as
+	// in semver, "include" matches prereleases like any other version and
+	// "exclude" ignores prerelease versions of the user.
+	Prerelease string `json:"prerelease,omitempty"`
+	// StrictSemver rejects versions with a "v" prefix or missing parts, like
+	// "v1.2", instead of reading them as "1.2.0".
+	StrictSemver bool `json:"strictSemver,omitempty"`
+	compiled     *compiledCondition
 }
 
 type EvalParam struct {
@@ -95,6 +204,19 @@ type EvalDetail struct {
 	VariationIndex *int
 	Version        *uint64
 	Reason         string
+	// SegmentMembershipStale is true when an unbounded segment was evaluated
+	// without an up-to-date SegmentMembershipStore.
+	SegmentMembershipStale bool
+	// ExperimentId is the experiment of the split which served the value, and
+	// InExperiment whether the user is in it.
+	ExperimentId string
+	InExperiment bool
+	// Holdout is the key of the holdout the user was held out by.
+	Holdout string
+	// Layer is the key of the experiment layer the user is in through this
+	// toggle, empty when the user is in the share of another toggle.
+	Layer string
+	split *SplitExplanation
 }
 
 type Prerequisite struct {
@@ -102,11 +224,21 @@ type Prerequisite struct {
 	Value interface{} `json:"value"`
 }
 
+const ReasonTargetMatch = "target match"
+
 var (
 	ErrPrerequisiteNotExist     = errors.New("prerequisite toggle not exist")
 	ErrPrerequisiteDeepOverflow = errors.New("prerequisite depth overflow")
+	ErrMalformedFlag            = errors.New("malformed flag")
 )
 
+// Bucket returns the bucket of key hashed with salt, in [0, 10000), the way
+// splits bucket users: the last 4 bytes of the SHA-1 of key followed by salt,
+// read as a big-endian unsigned integer, modulo 10000.
+func Bucket(key string, salt string) int {
+	return saltHash(key, salt, 10000)
+}
+
 func saltHash(key string, salt string, bucketSize uint32) int {
 	h := sha1.New()
 	h.Write([]byte(key + salt))
@@ -134,6 +266,47 @@ func (r *Range) UnmarshalJSON(data []byte) error {
 	return nil
 }
 
+func (t *Target) UnmarshalJSON(data []byte) error {
+	type target Target
+	var raw target
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	raw.keySet = newKeySet(raw.Keys)
+	*t = Target(raw)
+	return nil
+}
+
+func (t *Target) contains(key string) bool {
+	return containsKey(t.keySet, t.Keys, key)
+}
+
+func newKeySet(keys []string) map[string]struct{} {
+	set := make(map[string]struct{}, len(keys))
+	for _, key := range keys {
+		set[key] = struct{}{}
+	}
+	return set
+}
+
+// containsKey looks key up in set, or in keys when the set isn't built.
+func containsKey(set map[string]struct{}, keys []string, key string) bool {
+	if set == nil {
+		for _, k := range keys {
+			if k == key {
+				return true
+			}
+		}
+		return false
+	}
+	_, ok := set[key]
+	return ok
+}
+
+func (r Range) MarshalJSON() ([]byte, error) {
+	return json.Marshal([]int{r.Lower, r.Upper})
+}
+
 func (t *Toggle) eval(user FPUser, toggles map[string]Toggle, segments map[string]Segment, defaultValue interface{}, depth int) (interface{}, error) {
 	detail, err := t.evalDetail(user, toggles, segments, defaultValue, depth)
 	return detail.Value, err
@@ -141,6 +314,7 @@ func (t *Toggle) eval(user FPUser, toggles map[string]Toggle, segments map[strin
 
 func (t *Toggle) evalDetail(user FPUser, toggles map[string]Toggle, segments map[string]Segment, defaultValue interface{}, depth int) (EvalDetail, error) {
 	detail, err := t.doEvalDetail(user, toggles, segments, defaultValue, depth)
+	// ErrPrerequisiteCycle wraps ErrPrerequisiteDeepOverflow
 	if errors.Is(err, ErrPrerequisiteDeepOverflow) || errors.Is(err, ErrPrerequisiteNotExist) {
 		disabledDetail, evalErr := t.createDisabledEvalDetail(EvalParam{
 			User:       user,
@@ -160,6 +334,9 @@ func (t *Toggle) meetPrerequisite(user FPUser, toggles map[string]Toggle, segmen
 	if t.Prerequisites == nil && len(t.Prerequisites) == 0 {
 		return true, nil
 	}
+	if t.prerequisiteCycle {
+		return false, ErrPrerequisiteCycle
+	}
 	for _, prerequisite := range t.Prerequisites {
 		toggle, exists := toggles[prerequisite.Key]
 		if !exists {
@@ -169,7 +346,7 @@ func (t *Toggle) meetPrerequisite(user FPUser, toggles map[string]Toggle, segmen
 		if err != nil {
 			return false, err
 		}
-		if result.Value == nil || fmt.Sprintf("%v", result.Value) != fmt.Sprintf("%v", prerequisite.Value) {
+		if result.Value == nil || !jsonValueEqual(result.Value, prerequisite.Value) {
 			return false, nil
 		}
 	}
@@ -196,13 +373,21 @@ func (t *Toggle) doEvalDetail(user FPUser, toggles map[string]Toggle, segments m
 	if !match {
 		return t.createDisabledEvalDetail(params, defaultValue)
 	}
+	for _, target := range t.Targets {
+		if target.contains(user.Key()) {
+			variation := target.Variation
+			serve := Serve{Select: &variation}
+			return t.createPredefinedEvalDetail(params, defaultValue, serve, ReasonTargetMatch)
+		}
+	}
 	for ruleIndex, rule := range t.Rules {
-		serve, vi, err := rule.serveVariation(params)
+		serve, vi, allocation, err := rule.serveVariation(params)
 		if err != nil {
 			return t.buildEvalDetail(defaultValue, &ruleIndex, nil, err.Error()), err
 		}
 		if serve != nil {
-			return t.buildEvalDetail(serve, &ruleIndex, vi, fmt.Sprintf("rule %d ", ruleIndex)), nil
+			detail := t.buildEvalDetail(serve, &ruleIndex, vi, fmt.Sprintf("rule %d ", ruleIndex))
+			return allocation.apply(detail), nil
 		}
 	}
 	return t.createDefaultEvalDetail(params, defaultValue)
@@ -219,11 +404,11 @@ func (t *Toggle) createDisabledEvalDetail(params EvalParam, defaultValue interfa
 func (t *Toggle) createPredefinedEvalDetail(params EvalParam, defaultValue interface{},
 predefinedServe Serve, reason string) (EvalDetail,
 	error) {
-	serve, vi, err := predefinedServe.selectVariation(params)
+	serve, vi, allocation, err := predefinedServe.serve(params)
 	if err != nil {
 		return t.buildEvalDetail(defaultValue, nil, nil, err.Error()), err
 	}
-	return t.buildEvalDetail(serve, nil, vi, reason), nil
+	return allocation.apply(t.buildEvalDetail(serve, nil, vi, reason)), nil
 }
 
 func (t *Toggle) buildEvalDetail(value interface{}, ruleIndex *int, variationIndex *int, reason string) EvalDetail {
@@ -237,29 +422,83 @@ func (t *Toggle) buildEvalDetail(value interface{}, ruleIndex *int, variationInd
 
 }
 
+func (a splitAllocation) apply(detail EvalDetail) EvalDetail {
+	detail.ExperimentId = a.experimentId
+	detail.InExperiment = a.inExperiment
+	detail.Holdout = a.holdout
+	detail.Layer = a.layer
+	if a.explanation != nil {
+		explanation := *a.explanation
+		explanation.RuleIndex = detail.RuleIndex
+		detail.split = &explanation
+	}
+	return detail
+}
+
 func (s *Serve) selectVariation(params EvalParam) (interface{}, *int, error) {
+	value, index, _, err := s.serve(params)
+	return value, index, err
+}
+
+// serve selects the variation like selectVariation, and tells how the split
+// allocated the user when it is a split.
+func (s *Serve) serve(params EvalParam) (interface{}, *int, splitAllocation, error) {
 	var index *int = nil
+	var allocation splitAllocation
 	if s.Select != nil {
 		index = s.Select
+	} else if s.Split == nil {
+		return nil, nil, allocation, fmt.Errorf("%w: serve has neither select nor split", ErrMalformedFlag)
 	} else {
-		i, err := s.Split.findIndex(params)
+		i, a, err := s.Split.allocate(params)
 		if err != nil {
-			return nil, nil, err
+			return nil, nil, allocation, err
 		}
-		index = &i
+		index, allocation = &i, a
 	}
 
 	length := len(params.Variations)
-	if *index >= length {
-		return nil, nil, fmt.Errorf("index %d overflow, variations count is %d", index, length)
+	if *index < 0 || *index >= length {
+		return nil, nil, splitAllocation{}, fmt.Errorf("%w: index %d overflow, variations count is %d",
+			ErrMalformedFlag, *index, length)
 	}
-	return params.Variations[*index], index, nil
+	return params.Variations[*index], index, allocation, nil
 }
 
 func (s *Split) findIndex(params EvalParam) (int, error) {
+	variation, _, err := s.allocate(params)
+	return variation, err
+}
+
+// allocate returns the variation of the user, the holdout variation when the
+// user is held out.
+func (s *Split) allocate(params EvalParam) (int, splitAllocation, error) {
+	allocation := splitAllocation{experimentId: s.ExperimentId}
 	hashKey, err := s.hashKey(params)
 	if err != nil {
-		return -1, err
+		return -1, allocation, err
+	}
+	explanation := &SplitExplanation{HashKey: hashKey, BucketBy: s.BucketBy}
+	allocation.explanation = explanation
+
+	if s.Holdout != nil {
+		salt, bucketIndex, r, ok := s.Holdout.bucket(hashKey)
+		if ok {
+			allocation.holdout = s.Holdout.Key
+			explanation.Salt, explanation.BucketIndex, explanation.Range = salt, bucketIndex, r
+			explanation.VariationIndex, explanation.Holdout = s.Holdout.Variation, s.Holdout.Key
+			return s.Holdout.Variation, allocation, nil
+		}
+	}
+	if s.Layer != nil {
+		salt, bucketIndex, _, ok := s.Layer.bucket(hashKey)
+		if !ok {
+			explanation.Salt, explanation.BucketIndex = salt, bucketIndex
+			explanation.VariationIndex, explanation.OutsideLayer = s.Layer.Variation, true
+			return s.Layer.Variation, allocation, nil
+		}
+		allocation.layer = s.Layer.Key
+		explanation.Layer = s.Layer.Key
 	}
 
 	var salt string
@@ -271,24 +510,53 @@ func (s *Split) findIndex(params EvalParam) (int, error) {
 
 	bucketIndex := saltHash(hashKey, salt, 10000)
 
-	variation := s.getVariation(bucketIndex)
+	variation, r := s.getVariationRange(bucketIndex)
 
 	if variation == -1 {
-		return variation, fmt.Errorf("not find hash_bucket in distribution")
+		return variation, allocation, fmt.Errorf("not find hash_bucket in distribution")
 	}
 
-	return variation, nil
+	allocation.inExperiment = s.ExperimentId != ""
+	explanation.Salt, explanation.BucketIndex, explanation.Range = salt, bucketIndex, r
+	explanation.VariationIndex = variation
+	return variation, allocation, nil
+}
+
+// salt returns Salt, or else Key.
+func (b *BucketShare) salt() string {
+	if len(b.Salt) == 0 {
+		return b.Key
+	}
+	return b.Salt
+}
+
+// bucket returns the salt and the bucket of hashKey, with the range it is in
+// when ok.
+func (b *BucketShare) bucket(hashKey string) (string, int, Range, bool) {
+	salt := b.salt()
+	bucketIndex := saltHash(hashKey, salt, 10000)
+	for _, r := range b.Ranges {
+		if r.Lower <= bucketIndex && bucketIndex < r.Upper {
+			return salt, bucketIndex, r, true
+		}
+	}
+	return salt, bucketIndex, Range{}, false
 }
 
 func (s *Split) getVariation(bucketIndex int) int {
+	variation, _ := s.getVariationRange(bucketIndex)
+	return variation
+}
+
+func (s *Split) getVariationRange(bucketIndex int) (int, Range) {
 	for v, d := range s.Distribution {
 		for _, r := range d {
 			if r.Lower <= bucketIndex && bucketIndex < r.Upper {
-				return v
+				return v, r
 			}
 		}
 	}
-	return -1
+	return -1, Range{}
 }
 
 func (s *Split) hashKey(params EvalParam) (string, error) {
@@ -298,7 +566,7 @@ func (s *Split) hashKey(params EvalParam) (string, error) {
 		hashKey = user.Key()
 	} else {
 		bucketBy := s.BucketBy
-		key := user.Get(bucketBy)
+		key := user.bucketKey(bucketBy)
 		if len(key) != 0 {
 			hashKey = key
 		} else {
@@ -308,13 +576,27 @@ func (s *Split) hashKey(params EvalParam) (string, error) {
 	return hashKey, nil
 }
 
-func (r *Rule) serveVariation(params EvalParam) (interface{}, *int, error) {
+func (r *Rule) serveVariation(params EvalParam) (interface{}, *int, splitAllocation, error) {
+	for _, c := range r.Conditions {
+		if err := c.malformed(); err != nil {
+			return nil, nil, splitAllocation{}, err
+		}
+	}
 	for _, c := range r.Conditions {
 		if !c.meet(params.User, params.Segments) {
-			return nil, nil, nil
+			return nil, nil, splitAllocation{}, nil
 		}
 	}
-	return r.Serve.selectVariation(params)
+	return r.Serve.serve(params)
+}
+
+// malformed returns the error of a condition that can't be evaluated, nil
+// when it is well formed.
+func (c *Condition) malformed() error {
+	if c.compiled != nil {
+		return c.compiled.malformed
+	}
+	return malformedCondition(*c)
 }
 
 func (c *Condition) meet(user FPUser, segments map[string]Segment) bool {
@@ -329,6 +611,12 @@ func (c *Condition) meet(user FPUser, segments map[string]Segment) bool {
 		return c.matchSemverCondition(user, c.Predicate)
 	case "number":
 		return c.matchNumberCondition(user, c.Predicate)
+	case "ip":
+		return c.matchIpCondition(user, c.Predicate)
+	case "list":
+		return c.matchListCondition(user, c.Predicate)
+	case "boolean":
+		return c.matchBooleanCondition(user, c.Predicate)
 	}
 
 	return false
@@ -336,28 +624,11 @@ func (c *Condition) meet(user FPUser, segments map[string]Segment) bool {
 
 func (c *Condition) matchStringCondition(user FPUser, predicate string) bool {
 
-	if !user.ContainAttr(c.Subject) {
+	if _, ok := user.lookup(c.Subject); !ok {
 		return false
 	}
-	customValue := user.Get(c.Subject)
 
 	switch predicate {
-	case "is one of":
-		return c.matchObjects(func(o string) bool { return customValue == o })
-	case "starts with":
-		return c.matchObjects(func(o string) bool { return strings.HasPrefix(customValue, o) })
-	case "ends with":
-		return c.matchObjects(func(o string) bool { return strings.HasSuffix(customValue, o) })
-	case "contains":
-		return c.matchObjects(func(o string) bool { return strings.Contains(customValue, o) })
-	case "matches regex":
-		return c.matchObjects(func(o string) bool {
-			matched, err := regexp.Match(o, []byte(customValue))
-			if err != nil {
-				return false
-			}
-			return matched
-		})
 	case "is not any of":
 		return !c.matchStringCondition(user, "is one of")
 	case "does not start with":
@@ -370,59 +641,194 @@ func (c *Condition) matchStringCondition(user FPUser, predicate string) bool {
 		return !c.matchStringCondition(user, "matches regex")
 	}
 
+	for _, customValue := range user.stringValues(c.Subject) {
+		if c.matchString(customValue, predicate) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Condition) matchString(customValue string, predicate string) bool {
+	if predicate == "matches regex" {
+		return c.matchRegex(c.normalizeForm(customValue))
+	}
+	customValue = c.normalizeString(customValue)
+
+	switch predicate {
+	case "is one of":
+		if c.compiled != nil {
+			_, ok := c.compiled.objectSet[customValue]
+			return ok
+		}
+		return c.matchStringObjects(func(o string) bool { return customValue == o })
+	case "starts with":
+		return c.matchStringObjects(func(o string) bool { return strings.HasPrefix(customValue, o) })
+	case "ends with":
+		return c.matchStringObjects(func(o string) bool { return strings.HasSuffix(customValue, o) })
+	case "contains":
+		return c.matchStringObjects(func(o string) bool { return strings.Contains(customValue, o) })
+	}
+
+	return false
+}
+
+func (c *Condition) matchRegex(customValue string) bool {
+	if c.compiled != nil && c.compiled.regexps != nil {
+		for _, r := range c.compiled.regexps {
+			if r != nil && r.MatchString(customValue) {
+				return true
+			}
+		}
+		return false
+	}
+	return c.matchObjects(func(o string) bool {
+		matched, err := regexp.MatchString(c.regexPattern(o), customValue)
+		if err != nil {
+			return false
+		}
+		return matched
+	})
+}
+
+// regexPattern returns the pattern o with the flags of the condition.
+func (c *Condition) regexPattern(o string) string {
+	flags := c.RegexFlags
+	if c.IgnoreCase && !strings.Contains(flags, "i") {
+		flags += "i"
+	}
+	o = c.normalizeForm(o)
+	if flags == "" {
+		return o
+	}
+	return "(?" + flags + ")" + o
+}
+
+// normalizeForm returns s in NFC form when the condition normalizes strings.
+func (c *Condition) normalizeForm(s string) string {
+	if c.Normalize {
+		return norm.NFC.String(s)
+	}
+	return s
+}
+
+// normalizeString returns s as compared by the condition, normalized and case
+// folded according to its flags.
+func (c *Condition) normalizeString(s string) string {
+	s = c.normalizeForm(s)
+	if c.IgnoreCase {
+		// a Caser is stateful and can't be shared
+		s = cases.Fold().String(s)
+	}
+	return s
+}
+
+// stringObjects returns the objects normalized by normalizeString.
+func (c *Condition) stringObjects() []string {
+	if !c.IgnoreCase && !c.Normalize {
+		return c.Objects
+	}
+	if c.compiled != nil && c.compiled.objects != nil {
+		return c.compiled.objects
+	}
+	objects := make([]string, len(c.Objects))
+	for i, o := range c.Objects {
+		objects[i] = c.normalizeString(o)
+	}
+	return objects
+}
+
+func (c *Condition) matchStringObjects(f func(string) bool) bool {
+	for _, o := range c.stringObjects() {
+		if f(o) {
+			return true
+		}
+	}
 	return false
 }
 
 func (c *Condition) matchSegmentCondition(user FPUser, predicate string, segments map[string]Segment) bool {
+	return c.matchNestedSegmentCondition(user, predicate, segments, nil)
+}
+
+// matchNestedSegmentCondition matches a segment condition of the rules of the
+// segments in path, the condition fails whatever its predicate when it refers
+// to one of them.
+func (c *Condition) matchNestedSegmentCondition(user FPUser, predicate string, segments map[string]Segment,
+	path []string) bool {
 	if segments == nil {
 		return false
 	}
+	in, ok := c.userInSegments(user, segments, path)
+	if !ok {
+		return false
+	}
 	switch predicate {
 	case "is in":
-		return c.userInSegments(user, segments)
+		return in
 	case "is not in":
-		return !c.userInSegments(user, segments)
+		return !in
 	}
 	return false
 }
 
-func (c *Condition) userDatetime(user FPUser) (int64, error) {
-	customValue := user.Get(c.Subject)
-	if len(customValue) == 0 {
-		return time.Now().Unix(), nil
+// userDatetimes returns the datetimes of the user attribute, the evaluation
+// time when the condition has no subject or the attribute is missing.
+func (c *Condition) userDatetimes(user FPUser) []time.Time {
+	if v, ok := user.lookup(c.Subject); !ok || formatAttr(v) == "" {
+		return []time.Time{user.evaluationTime()}
 	}
-	return strconv.ParseInt(customValue, 10, 64)
+	return user.datetimeValues(c.Subject)
 }
 
 func (c *Condition) matchDatetimeCondition(user FPUser, predicate string) bool {
-	cv, err := c.userDatetime(user)
-	if err != nil {
-		return false
-	}
-	switch predicate {
-	case "after":
-		return c.matchDatetimeObjects(func(o int64) bool { return cv >= o })
-	case "before":
-		return c.matchDatetimeObjects(func(o int64) bool { return cv < o })
+	objects := c.datetimeObjects()
+	for _, cv := range c.userDatetimes(user) {
+		if objects.match(cv, predicate) {
+			return true
+		}
 	}
 	return false
 }
 
+func (c *Condition) datetimeObjects() *datetimeObjects {
+	if c.compiled != nil && c.compiled.datetime != nil {
+		return c.compiled.datetime
+	}
+	return parseDatetimeObjects(*c)
+}
+
 func (c *Condition) matchSemverCondition(user FPUser, predicate string) bool {
-	customValue := user.Get(c.Subject)
-	if len(customValue) == 0 {
-		return false
+	var versions []*semver.Version
+	for _, customValue := range user.stringValues(c.Subject) {
+		cv, err := c.parseVersion(customValue)
+		if err != nil || (c.Prerelease == "exclude" && cv.Prerelease() != "") {
+			continue
+		}
+		versions = append(versions, cv)
 	}
-	cv, err := semver.NewVersion(customValue)
-	if err != nil {
+	if len(versions) == 0 {
 		return false
 	}
 
 	switch predicate {
-	case "=":
-		return c.matchSemVerObjects(func(o *semver.Version) bool { return cv.Equal(o) })
 	case "!=":
 		return !c.matchSemverCondition(user, "=")
+	case "does not satisfy":
+		return !c.matchSemverCondition(user, "satisfies")
+	}
+	for _, cv := range versions {
+		if c.matchSemver(cv, predicate) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Condition) matchSemver(cv *semver.Version, predicate string) bool {
+	switch predicate {
+	case "=":
+		return c.matchSemVerObjects(func(o *semver.Version) bool { return cv.Equal(o) })
 	case ">":
 		return c.matchSemVerObjects(func(o *semver.Version) bool { return cv.GreaterThan(o) })
 	case ">=":
@@ -431,27 +837,75 @@ func (c *Condition) matchSemverCondition(user FPUser, predicate string) bool {
 		return c.matchSemVerObjects(func(o *semver.Version) bool { return cv.LessThan(o) })
 	case "<=":
 		return c.matchSemVerObjects(func(o *semver.Version) bool { return cv.LessThan(o) || cv.Equal(o) })
+	case "satisfies":
+		for _, constraints := range c.semverConstraints() {
+			if constraints.Check(cv) {
+				return true
+			}
+		}
 	}
 
 	return false
+}
+
+func (c *Condition) parseVersion(s string) (*semver.Version, error) {
+	if c.StrictSemver {
+		return semver.StrictNewVersion(s)
+	}
+	return semver.NewVersion(s)
+}
+
+func (c *Condition) parseConstraints(s string) (*semver.Constraints, error) {
+	constraints, err := semver.NewConstraint(s)
+	if err != nil {
+		return nil, err
+	}
+	constraints.IncludePrerelease = c.Prerelease == "include"
+	return constraints, nil
+}
 
+func (c *Condition) semverConstraints() []*semver.Constraints {
+	if c.compiled != nil {
+		return c.compiled.constraints
+	}
+	return c.parseSemverConstraints()
+}
+
+// parseSemverConstraints parses the ranges of a "satisfies" condition, up to
+// the first invalid one.
+func (c *Condition) parseSemverConstraints() []*semver.Constraints {
+	var parsed []*semver.Constraints
+	for _, o := range c.Objects {
+		constraints, err := c.parseConstraints(o)
+		if err != nil {
+			break
+		}
+		parsed = append(parsed, constraints)
+	}
+	return parsed
 }
 
 func (c *Condition) matchNumberCondition(user FPUser, predicate string) bool {
-	customValue := user.Get(c.Subject)
-	if len(customValue) == 0 {
+	numbers := user.numberValues(c.Subject)
+	if len(numbers) == 0 {
 		return false
 	}
-	cv, err := strconv.ParseFloat(customValue, 32)
-	if err != nil {
-		return false
+
+	if predicate == "!=" {
+		return !c.matchNumberCondition(user, "=")
+	}
+	for _, cv := range numbers {
+		if c.matchNumber(cv, predicate) {
+			return true
+		}
 	}
+	return false
+}
 
+func (c *Condition) matchNumber(cv float64, predicate string) bool {
 	switch predicate {
 	case "=":
 		return c.matchNumberObjects(func(o float64) bool { return cv == o })
-	case "!=":
-		return !c.matchNumberCondition(user, "=")
 	case ">":
 		return c.matchNumberObjects(func(o float64) bool { return cv > o })
 	case ">=":
@@ -465,34 +919,158 @@ func (c *Condition) matchNumberCondition(user FPUser, predicate string) bool {
 	return false
 }
 
-func (c *Condition) userInSegments(user FPUser, segments map[string]Segment) bool {
-	for _, segmentKey := range c.Objects {
-		segment, ok := segments[segmentKey]
-		if ok {
-			if segment.contains(user) {
-				return true
+// matchIpCondition is false for both predicates when the user has no valid
+// address, addresses of a list attribute match if any of them is in a range.
+func (c *Condition) matchIpCondition(user FPUser, predicate string) bool {
+	var addrs []netip.Addr
+	for _, customValue := range user.stringValues(c.Subject) {
+		if addr, err := netip.ParseAddr(customValue); err == nil {
+			addrs = append(addrs, addr.WithZone("").Unmap())
+		}
+	}
+	if len(addrs) == 0 {
+		return false
+	}
+
+	switch predicate {
+	case "in cidr":
+		prefixes := c.ipPrefixes()
+		for _, addr := range addrs {
+			for _, prefix := range prefixes {
+				if prefix.Contains(addr) {
+					return true
+				}
 			}
 		}
+		return false
+	case "not in cidr":
+		return !c.matchIpCondition(user, "in cidr")
 	}
 	return false
 }
 
-func (c *Condition) matchObjects(f func(string) bool) bool {
-	for _, o := range c.Objects {
-		if f(o) {
-			return true
+func (c *Condition) ipPrefixes() []netip.Prefix {
+	if c.compiled != nil {
+		return c.compiled.prefixes
+	}
+	return parseIpPrefixes(c.Objects)
+}
+
+// parseIpPrefixes parses CIDR ranges, single addresses are taken as ranges of
+// one address and invalid objects are skipped.
+func parseIpPrefixes(objects []string) []netip.Prefix {
+	prefixes := make([]netip.Prefix, 0, len(objects))
+	for _, o := range objects {
+		if prefix, err := parseIpPrefix(o); err == nil {
+			prefixes = append(prefixes, prefix)
 		}
 	}
-	return false
+	return prefixes
 }
 
-func (c *Condition) matchDatetimeObjects(f func(int64) bool) bool {
-	for _, o := range c.Objects {
-		co, err := strconv.ParseInt(o, 10, 64)
+func parseIpPrefix(o string) (netip.Prefix, error) {
+	if !strings.Contains(o, "/") {
+		addr, err := netip.ParseAddr(o)
 		if err != nil {
+			return netip.Prefix{}, err
+		}
+		addr = addr.Unmap()
+		return netip.PrefixFrom(addr, addr.BitLen()), nil
+	}
+	prefix, err := netip.ParsePrefix(o)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	if prefix.Addr().Is4In6() && prefix.Bits() >= 96 {
+		prefix = netip.PrefixFrom(prefix.Addr().Unmap(), prefix.Bits()-96)
+	}
+	return prefix.Masked(), nil
+}
+
+// matchListCondition compares the elements of the user attribute with the
+// objects, a missing attribute never matches.
+func (c *Condition) matchListCondition(user FPUser, predicate string) bool {
+	if _, ok := user.lookup(c.Subject); !ok {
+		return false
+	}
+	values := make(map[string]struct{})
+	for _, v := range user.stringValues(c.Subject) {
+		values[c.normalizeString(v)] = struct{}{}
+	}
+
+	switch predicate {
+	case "contains any":
+		return c.matchStringObjects(func(o string) bool {
+			_, ok := values[o]
+			return ok
+		})
+	case "contains all":
+		return !c.matchStringObjects(func(o string) bool {
+			_, ok := values[o]
+			return !ok
+		})
+	}
+	return false
+}
+
+// matchBooleanCondition accepts bool attributes and "true" or "false" strings,
+// a missing or other attribute matches neither predicate.
+func (c *Condition) matchBooleanCondition(user FPUser, predicate string) bool {
+	v, ok := user.lookup(c.Subject)
+	if !ok {
+		return false
+	}
+	var cv bool
+	switch value := v.(type) {
+	case bool:
+		cv = value
+	case string:
+		switch strings.ToLower(value) {
+		case "true":
+			cv = true
+		case "false":
+			cv = false
+		default:
 			return false
 		}
-		if f(co) {
+	default:
+		return false
+	}
+
+	switch predicate {
+	case "is true":
+		return cv
+	case "is false":
+		return !cv
+	}
+	return false
+}
+
+// userInSegments tells whether the user is in one of the condition segments,
+// ok is false when one of them is in path, which is a segment cycle.
+func (c *Condition) userInSegments(user FPUser, segments map[string]Segment, path []string) (in bool, ok bool) {
+	for _, segmentKey := range c.Objects {
+		for _, key := range path {
+			if key == segmentKey {
+				return false, false
+			}
+		}
+	}
+	for _, segmentKey := range c.Objects {
+		segment, ok := segments[segmentKey]
+		if ok {
+			nested := append(path[:len(path):len(path)], segmentKey)
+			if segment.contains(user, segments, nested) {
+				return true, true
+			}
+		}
+	}
+	return false, true
+}
+
+func (c *Condition) matchObjects(f func(string) bool) bool {
+	for _, o := range c.Objects {
+		if f(o) {
 			return true
 		}
 	}
@@ -500,6 +1078,14 @@ func (c *Condition) matchDatetimeObjects(f func(int64) bool) bool {
 }
 
 func (c *Condition) matchNumberObjects(f func(float64) bool) bool {
+	if c.compiled != nil {
+		for _, co := range c.compiled.numbers {
+			if f(co) {
+				return true
+			}
+		}
+		return false
+	}
 	for _, o := range c.Objects {
 		co, err := strconv.ParseFloat(o, 32)
 		if err != nil {
@@ -513,8 +1099,16 @@ func (c *Condition) matchNumberObjects(f func(float64) bool) bool {
 }
 
 func (c *Condition) matchSemVerObjects(f func(*semver.Version) bool) bool {
+	if c.compiled != nil {
+		for _, co := range c.compiled.versions {
+			if f(co) {
+				return true
+			}
+		}
+		return false
+	}
 	for _, o := range c.Objects {
-		co, err := semver.NewVersion(o)
+		co, err := c.parseVersion(o)
 		if err != nil {
 			return false
 		}
@@ -525,72 +1119,75 @@ func (c *Condition) matchSemVerObjects(f func(*semver.Version) bool) bool {
 	return false
 }
 
-func (s *Segment) contains(user FPUser) bool {
+// contains tells whether the user is in the segment, path lists the segments
+// being evaluated, the segment included.
+func (s *Segment) contains(user FPUser, segments map[string]Segment, path []string) bool {
+	key := user.Key()
+	if containsKey(s.excludedSet, s.Excluded, key) {
+		return false
+	}
+	if containsKey(s.includedSet, s.Included, key) {
+		return true
+	}
+	if s.Unbounded {
+		if included, ok := user.memberships.contains(s.UniqId); ok {
+			return included
+		}
+	}
 	for _, rule := range s.Rules {
-		if rule.allow(user) {
+		if rule.allow(user, segments, path) {
 			return true
 		}
 	}
 	return false
 }
 
-func (r *Rule) allow(user FPUser) bool {
+// allow tells whether the user meets all the conditions of a segment rule.
+func (r *Rule) allow(user FPUser, segments map[string]Segment, path []string) bool {
 	for _, condition := range r.Conditions {
-		if condition.meet(user, nil) {
-			return true
+		if condition.Type == "segment" {
+			if !condition.matchNestedSegmentCondition(user, condition.Predicate, segments, path) {
+				return false
+			}
+		} else if !condition.meet(user, segments) {
+			return false
 		}
 	}
-	return false
+	return true
 }
 
-func (repo *Repository) Clear() {
-	repo.toggles.Store(make(map[string]Toggle))
-	repo.segments.Store(make(map[string]Segment))
-	repo.debugUntilTime.Store(0)
+// NewRepository creates a repository keeping its toggles in store, a nil
+// store means the default MemoryStore.
+func NewRepository(store ToggleStore) *Repository {
+	return &Repository{store: store}
 }
 
-func (repo *Repository) getToggles() (result map[string]Toggle) {
-	toggles := repo.toggles.Load()
-	if toggles == nil {
-		return make(map[string]Toggle)
+// Store returns the ToggleStore backing the repository.
+func (repo *Repository) Store() ToggleStore {
+	if repo.store == nil {
+		return &repo.memory
 	}
-	result = toggles.(map[string]Toggle)
-	return
+	return repo.store
 }
 
-func (repo *Repository) getToggle(toggleKey string) (result Toggle, ok bool) {
-	toggles := repo.toggles.Load()
-	if toggles == nil {
-		return Toggle{}, false
-	}
-	togglesMap, ok := toggles.(map[string]Toggle)
-	if !ok {
-		return Toggle{}, false
-	}
-	result, ok = togglesMap[toggleKey]
-	return
+func (repo *Repository) Clear() {
+	repo.Store().Apply(RepositoryData{
+		Toggles:  make(map[string]Toggle),
+		Segments: make(map[string]Segment),
+	})
+	repo.debugUntilTime.Store(0)
 }
 
-func (repo *Repository) getSegments() (result map[string]Segment) {
-	segments := repo.segments.Load()
-	if segments == nil {
-		return make(map[string]Segment)
-	}
-	result = segments.(map[string]Segment)
-	return
+func (repo *Repository) getToggles() map[string]Toggle {
+	return repo.Store().All()
 }
 
-func (repo *Repository) getSegment(segmentKey string) (result Segment, ok bool) {
-	segments := repo.toggles.Load()
-	if segments == nil {
-		return Segment{}, false
-	}
-	segmentsMap, ok := segments.(map[string]Segment)
-	if !ok {
-		return Segment{}, false
-	}
-	result, ok = segmentsMap[segmentKey]
-	return
+func (repo *Repository) getToggle(toggleKey string) (Toggle, bool) {
+	return repo.Store().Get(toggleKey)
+}
+
+func (repo *Repository) getSegments() map[string]Segment {
+	return repo.Store().Segments()
 }
 
 func (repo *Repository) getDebugUntilTime() (result uint64) {
@@ -598,8 +1195,25 @@ func (repo *Repository) getDebugUntilTime() (result uint64) {
 	return
 }
 
+func (repo *Repository) validationReport() ValidationReport {
+	report, ok := repo.report.Load().(ValidationReport)
+	if !ok {
+		return ValidationReport{}
+	}
+	return report
+}
+
 func (repo *Repository) flush(data RepositoryData) {
-	repo.toggles.Store(data.Toggles)
-	repo.segments.Store(data.Segments)
+	report := ValidateRepositoryData(data)
+	if !report.Empty() && report.String() != repo.validationReport().String() {
+		fmt.Printf("FP found malformed toggles:\n%s\n", report)
+	}
+	repo.report.Store(report)
+	store := repo.Store()
+	data = compileRepositoryData(data, store.All(), store.Segments())
+	if data.Toggles != nil {
+		markPrerequisiteCycles(data)
+	}
+	store.Apply(data)
 	repo.debugUntilTime.Store(data.DebugUntilTime)
 }
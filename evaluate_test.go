@@ -1,16 +1,20 @@
 package featureprobe
 
 import (
+	"crypto/sha1"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"strconv"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
 )
 
-func loadRepoFromFile() (repo Repository, err error) {
+func loadRepoFromFile() (repo *Repository, err error) {
+	repo = &Repository{}
 	bytes, _ := ioutil.ReadFile("./resources/fixtures/repo.json")
 	repoData := RepositoryData{}
 	err = json.Unmarshal(bytes, &repoData)
@@ -30,6 +34,41 @@ func TestSaltHash(t *testing.T) {
 	assert.Equal(t, h, 2647)
 }
 
+// bucketCases are computed outside of this SDK, other implementations must
+// compute the same buckets:
+//
+//	bucket = uint32_big_endian(last_4_bytes(sha1(utf8(key + salt)))) mod 10000
+//
+// which is in MySQL:
+//
+//	SELECT CAST(CONV(RIGHT(SHA1(CONCAT(`key`, salt)), 8), 16, 10) AS UNSIGNED) % 10000
+var bucketCases = []struct {
+	key    string
+	salt   string
+	sha1   string
+	bucket int
+}{
+	{"key", "salt", "00144a023ce7a9e612a842d8753b0ffbdee16207", 2647},
+	{"user1", "toggle_key", "db7c56f737140f842b7eb23e00b91d83fcd9874d", 4381},
+	{"", "checkout", "d5491e7e7124a22dd73fa746ba129c59f9dc6d5d", 2701},
+	{"13800138000", "exp_2024", "ef16bb383256316f2ee27427d273d5db35acb652", 1314},
+	{"\u7528\u6237", "", "9ba763ea34238bdf5c2cb4407507e21a8fc6521b", 9035},
+}
+
+func TestBucket(t *testing.T) {
+	for _, c := range bucketCases {
+		assert.Equal(t, c.bucket, Bucket(c.key, c.salt), "key %q salt %q", c.key, c.salt)
+
+		// the pseudo-code above, on the hexadecimal digest like the SQL query
+		digest := sha1.Sum([]byte(c.key + c.salt))
+		hexDigest := hex.EncodeToString(digest[:])
+		assert.Equal(t, c.sha1, hexDigest)
+		last4Bytes, err := strconv.ParseUint(hexDigest[len(hexDigest)-8:], 16, 32)
+		assert.Nil(t, err)
+		assert.Equal(t, c.bucket, int(last4Bytes%10000))
+	}
+}
+
 func TestMatchInSegmentCondition(t *testing.T) {
 	repo, err := loadRepoFromFile()
 	assert.Equal(t, nil, err)
@@ -94,6 +133,91 @@ func TestSegmentsUnknownPredicate(t *testing.T) {
 	assert.False(t, r)
 }
 
+func nestedSegments() map[string]Segment {
+	inSegment := func(keys ...string) Condition {
+		return Condition{Type: "segment", Predicate: "is in", Objects: keys}
+	}
+	return map[string]Segment{
+		"beta": {Key: "beta", Included: []string{"tester"}, Excluded: []string{"banned"},
+			Rules: []Rule{{Conditions: []Condition{
+				{Type: "string", Subject: "city", Predicate: "is one of", Objects: []string{"Paris"}},
+				{Type: "string", Subject: "os", Predicate: "is one of", Objects: []string{"linux"}},
+			}}}},
+		"beta_and_staff": {Key: "beta_and_staff", Rules: []Rule{{Conditions: []Condition{
+			inSegment("beta"),
+			{Type: "string", Subject: "email", Predicate: "ends with", Objects: []string{"@company.com"}},
+		}}}},
+		"loop_a": {Key: "loop_a", Rules: []Rule{{Conditions: []Condition{inSegment("loop_b")}}}},
+		"loop_b": {Key: "loop_b", Rules: []Rule{{Conditions: []Condition{
+			{Type: "segment", Predicate: "is not in", Objects: []string{"loop_a"}},
+		}}}},
+	}
+}
+
+func TestSegmentRuleAllConditions(t *testing.T) {
+	segments := nestedSegments()
+	segment := segments["beta"]
+
+	user := NewUser().StableRollout("user").With("city", "Paris").With("os", "linux")
+	assert.True(t, segment.contains(user, segments, []string{"beta"}))
+	user = NewUser().StableRollout("user").With("city", "Paris").With("os", "macos")
+	assert.False(t, segment.contains(user, segments, []string{"beta"}))
+}
+
+func TestSegmentIncludedAndExcluded(t *testing.T) {
+	segments := nestedSegments()
+	c := Condition{Type: "segment", Predicate: "is in", Objects: []string{"beta"}}
+
+	assert.True(t, c.meet(NewUser().StableRollout("tester"), segments))
+	banned := NewUser().StableRollout("banned").With("city", "Paris").With("os", "linux")
+	assert.False(t, c.meet(banned, segments))
+
+	segment := segments["beta"]
+	segment.Included = append(segment.Included, "banned")
+	segments["beta"] = segment
+	assert.False(t, c.meet(banned, segments))
+}
+
+func TestCompiledSegmentKeySets(t *testing.T) {
+	data := compileRepositoryData(RepositoryData{Segments: nestedSegments()}, nil, nil)
+	segment := data.Segments["beta"]
+	assert.Equal(t, 1, len(segment.includedSet))
+	assert.Equal(t, 1, len(segment.excludedSet))
+
+	c := Condition{Type: "segment", Predicate: "is in", Objects: []string{"beta"}}
+	assert.True(t, c.meet(NewUser().StableRollout("tester"), data.Segments))
+	banned := NewUser().StableRollout("banned").With("city", "Paris").With("os", "linux")
+	assert.False(t, c.meet(banned, data.Segments))
+}
+
+func TestNestedSegments(t *testing.T) {
+	segments := nestedSegments()
+	c := Condition{Type: "segment", Predicate: "is in", Objects: []string{"beta_and_staff"}}
+
+	user := NewUser().StableRollout("tester").With("email", "tester@company.com")
+	assert.True(t, c.meet(user, segments))
+	user = NewUser().StableRollout("user").With("email", "user@company.com")
+	assert.False(t, c.meet(user, segments))
+	user = NewUser().StableRollout("tester").With("email", "tester@example.com")
+	assert.False(t, c.meet(user, segments))
+}
+
+func TestSegmentCycle(t *testing.T) {
+	segments := nestedSegments()
+	user := NewUser().StableRollout("user")
+
+	// the condition closing the cycle fails whatever its predicate: from loop_a
+	// it is "is not in loop_a", from loop_b it is "is in loop_b"
+	c := Condition{Type: "segment", Predicate: "is in", Objects: []string{"loop_a"}}
+	assert.False(t, c.meet(user, segments))
+	c.Predicate = "is not in"
+	assert.True(t, c.meet(user, segments))
+	c.Objects = []string{"loop_b"}
+	assert.False(t, c.meet(user, segments))
+	c.Predicate = "is in"
+	assert.True(t, c.meet(user, segments))
+}
+
 func TestMultiConditions(t *testing.T) {
 	repo, _ := loadRepoFromFile()
 
@@ -208,6 +332,110 @@ func TestDistributionNoSalt(t *testing.T) {
 	assert.Equal(t, index, 2)
 }
 
+func setupExperimentToggle(key string, holdout *Holdout) Toggle {
+	control := 2
+	return Toggle{
+		Key:           key,
+		Enabled:       true,
+		Version:       1,
+		DisabledServe: Serve{Select: &control},
+		DefaultServe: Serve{Split: &Split{
+			Distribution: [][]Range{{{Lower: 0, Upper: 5000}}, {{Lower: 5000, Upper: 10000}}, {}},
+			ExperimentId: "exp_" + key,
+			Holdout:      holdout,
+		}},
+		Variations: []interface{}{"a", "b", "control"},
+	}
+}
+
+func TestSplitExperiment(t *testing.T) {
+	toggle := setupExperimentToggle("checkout", nil)
+	user := NewUser().StableRollout("user")
+
+	detail, err := toggle.evalDetail(user, nil, nil, "default", 10)
+	assert.Nil(t, err)
+	assert.NotEqual(t, "control", detail.Value)
+	assert.Equal(t, "exp_checkout", detail.ExperimentId)
+	assert.True(t, detail.InExperiment)
+	assert.Empty(t, detail.Holdout)
+
+	toggle.DefaultServe.Split.ExperimentId = ""
+	detail, _ = toggle.evalDetail(user, nil, nil, "default", 10)
+	assert.False(t, detail.InExperiment)
+
+	zero := 0
+	toggle.DefaultServe = Serve{Select: &zero}
+	detail, _ = toggle.evalDetail(user, nil, nil, "default", 10)
+	assert.Empty(t, detail.ExperimentId)
+	assert.False(t, detail.InExperiment)
+}
+
+func TestSplitHoldout(t *testing.T) {
+	holdout := &Holdout{Key: "q4_holdout", Ranges: []Range{{Lower: 0, Upper: 10000}}, Variation: 2}
+	toggle := setupExperimentToggle("checkout", holdout)
+
+	detail, err := toggle.evalDetail(NewUser().StableRollout("user"), nil, nil, "default", 10)
+	assert.Nil(t, err)
+	assert.Equal(t, "control", detail.Value)
+	assert.Equal(t, "exp_checkout", detail.ExperimentId)
+	assert.False(t, detail.InExperiment)
+	assert.Equal(t, "q4_holdout", detail.Holdout)
+}
+
+func TestSplitHoldoutAcrossToggles(t *testing.T) {
+	holdout := &Holdout{Key: "q4_holdout", Ranges: []Range{{Lower: 0, Upper: 5000}}, Variation: 2}
+	checkout := setupExperimentToggle("checkout", holdout)
+	search := setupExperimentToggle("search", holdout)
+
+	heldOut := 0
+	for i := 0; i < 100; i++ {
+		user := NewUser().StableRollout(fmt.Sprintf("user%d", i))
+		checkoutDetail, _ := checkout.evalDetail(user, nil, nil, "default", 10)
+		searchDetail, _ := search.evalDetail(user, nil, nil, "default", 10)
+		assert.Equal(t, checkoutDetail.Holdout, searchDetail.Holdout)
+		assert.Equal(t, checkoutDetail.InExperiment, searchDetail.InExperiment)
+		if checkoutDetail.Holdout != "" {
+			heldOut++
+		}
+	}
+	assert.True(t, heldOut > 25 && heldOut < 75)
+}
+
+func setupLayerToggle(key string, ranges ...Range) Toggle {
+	toggle := setupExperimentToggle(key, nil)
+	toggle.DefaultServe.Split.Layer = &Layer{Key: "checkout_layer", Ranges: ranges, Variation: 2}
+	return toggle
+}
+
+func TestSplitLayer(t *testing.T) {
+	toggles := []Toggle{
+		setupLayerToggle("button_color", Range{Lower: 0, Upper: 3000}),
+		setupLayerToggle("button_text", Range{Lower: 3000, Upper: 6000}),
+		setupLayerToggle("price", Range{Lower: 6000, Upper: 8000}, Range{Lower: 9000, Upper: 10000}),
+	}
+
+	inLayer := map[string]int{}
+	for i := 0; i < 300; i++ {
+		user := NewUser().StableRollout(fmt.Sprintf("user%d", i))
+		experiments := 0
+		for _, toggle := range toggles {
+			detail, err := toggle.evalDetail(user, nil, nil, "default", 10)
+			assert.Nil(t, err)
+			if detail.InExperiment {
+				experiments++
+				inLayer[toggle.Key]++
+				assert.Equal(t, "checkout_layer", detail.Layer)
+				assert.NotEqual(t, "control", detail.Value)
+			} else {
+				assert.Empty(t, detail.Layer)
+				assert.Equal(t, "control", detail.Value)
+			}
+		}
+		assert.True(t, experiments <= 1)
+	}
+	assert.Equal(t, 3, len(inLayer))
+}
+
 func TestDistributionInExactBucket(t *testing.T) {
 	distribution := [][]Range{
 		{Range{Lower: 0, Upper: 2647}},
@@ -234,6 +462,39 @@ func TestDistributionInExactBucket(t *testing.T) {
 	assert.Equal(t, index, 1)
 }
 
+func TestDistributionByContextKey(t *testing.T) {
+	distribution := [][]Range{
+		{Range{Lower: 0, Upper: 2647}},
+		{Range{Lower: 2647, Upper: 2648}},
+		{Range{Lower: 2648, Upper: 10000}},
+	}
+
+	split := Split{
+		Distribution: distribution,
+		BucketBy:     "organization",
+		Salt:         "",
+	}
+
+	organization := NewUser().StableRollout("key")
+	params := EvalParam{
+		User:       NewUser().StableRollout("user1").WithContext("organization", organization),
+		Variations: nil,
+		Segments:   nil,
+		Key:        "salt",
+	}
+
+	index, _ := split.findIndex(params)
+	assert.Equal(t, index, 1)
+
+	params.User = NewUser().StableRollout("user2").WithContext("organization", organization)
+	index, _ = split.findIndex(params)
+	assert.Equal(t, index, 1)
+
+	params.User = NewUser().StableRollout("user3")
+	_, err := split.findIndex(params)
+	assert.NotNil(t, err)
+}
+
 func TestDistributionInNoneBucket(t *testing.T) {
 	distribution := [][]Range{
 		{Range{Lower: 0, Upper: 2647}},
@@ -624,11 +885,11 @@ func TestDatetimeBefore(t *testing.T) {
 	r := condition.meet(user, nil)
 	assert.True(t, r)
 
-	user.With("datetime", fmt.Sprintf("%d", now))
+	user = user.With("datetime", fmt.Sprintf("%d", now))
 	r = condition.meet(user, nil)
 	assert.True(t, r)
 
-	user.With("datetime", fmt.Sprintf("%d", now+1))
+	user = user.With("datetime", fmt.Sprintf("%d", now+1))
 	r = condition.meet(user, nil)
 	assert.False(t, r)
 }
@@ -648,15 +909,15 @@ func TestDatetimeAfter(t *testing.T) {
 	r := condition.meet(user, nil)
 	assert.True(t, r)
 
-	user.With("datetime", fmt.Sprintf("%d", now))
+	user = user.With("datetime", fmt.Sprintf("%d", now))
 	r = condition.meet(user, nil)
 	assert.True(t, r)
 
-	user.With("datetime", fmt.Sprintf("%d", now+1))
+	user = user.With("datetime", fmt.Sprintf("%d", now+1))
 	r = condition.meet(user, nil)
 	assert.True(t, r)
 
-	user.With("datetime", fmt.Sprintf("%d", now-1))
+	user = user.With("datetime", fmt.Sprintf("%d", now-1))
 	r = condition.meet(user, nil)
 	assert.False(t, r)
 }
@@ -1123,6 +1384,327 @@ func TestSemVerInvalid(t *testing.T) {
 	assert.False(t, r)
 }
 
+func TestSemVerSatisfies(t *testing.T) {
+	condition := Condition{
+		Type:      "semver",
+		Subject:   "version",
+		Predicate: "satisfies",
+		Objects:   []string{"^1.2 || >=3.0.0-beta"},
+	}
+
+	assert.True(t, condition.meet(NewUser().With("version", "1.4.0"), nil))
+	assert.False(t, condition.meet(NewUser().With("version", "2.0.0"), nil))
+	assert.True(t, condition.meet(NewUser().With("version", "3.0.0-rc.1"), nil))
+	assert.True(t, condition.meet(NewUser().With("version", "v1.2"), nil))
+	assert.False(t, condition.meet(NewUser().With("version", "invalid"), nil))
+
+	condition.Predicate = "does not satisfy"
+	assert.False(t, condition.meet(NewUser().With("version", "1.4.0"), nil))
+	assert.True(t, condition.meet(NewUser().With("version", "2.0.0"), nil))
+	assert.False(t, condition.meet(NewUser().With("version", "invalid"), nil))
+}
+
+func TestSemVerPrerelease(t *testing.T) {
+	condition := Condition{
+		Type:      "semver",
+		Subject:   "version",
+		Predicate: "satisfies",
+		Objects:   []string{">=1.2.0"},
+	}
+	user := NewUser().With("version", "1.3.0-beta")
+
+	assert.False(t, condition.meet(user, nil))
+	condition.Prerelease = "include"
+	assert.True(t, condition.meet(user, nil))
+
+	condition.Prerelease = "exclude"
+	condition.Predicate = ">="
+	assert.False(t, condition.meet(user, nil))
+	condition.Predicate = "!="
+	assert.False(t, condition.meet(user, nil))
+	assert.True(t, condition.meet(NewUser().With("version", "1.3.0"), nil))
+}
+
+func TestSemVerStrict(t *testing.T) {
+	condition := Condition{
+		Type:      "semver",
+		Subject:   "version",
+		Predicate: "=",
+		Objects:   []string{"1.2.0"},
+	}
+	user := NewUser().With("version", "v1.2")
+
+	assert.True(t, condition.meet(user, nil))
+	condition.StrictSemver = true
+	assert.False(t, condition.meet(user, nil))
+	assert.True(t, condition.meet(NewUser().With("version", "1.2.0"), nil))
+}
+
+func TestCompiledSemVerSatisfies(t *testing.T) {
+	condition := Condition{
+		Type:       "semver",
+		Subject:    "version",
+		Predicate:  "satisfies",
+		Objects:    []string{"~1.2", ">=2.0.0"},
+		Prerelease: "include",
+	}
+	compiled := condition
+	compiled.compiled = compileCondition(condition)
+
+	for _, version := range []string{"1.2.5", "1.3.0", "2.1.0-alpha", "0.9.0"} {
+		user := NewUser().With("version", version)
+		assert.Equal(t, condition.meet(user, nil), compiled.meet(user, nil))
+	}
+}
+
+func TestNumberNativeValue(t *testing.T) {
+	condition := Condition{
+		Type:      "number",
+		Subject:   "price",
+		Predicate: "=",
+		Objects: []string{
+			"0.1", "2",
+		},
+	}
+
+	user := NewUser().WithNumber("price", 0.1)
+	r := condition.meet(user, nil)
+	assert.True(t, r)
+
+	user = NewUser().WithNumber("price", 2)
+	r = condition.meet(user, nil)
+	assert.True(t, r)
+
+	user = NewUser().WithNumber("price", 2.5)
+	r = condition.meet(user, nil)
+	assert.False(t, r)
+
+	user = NewUser().WithBool("price", true)
+	r = condition.meet(user, nil)
+	assert.False(t, r)
+}
+
+func TestDatetimeNativeValue(t *testing.T) {
+	now := time.Now()
+	condition := Condition{
+		Type:      "datetime",
+		Subject:   "datetime",
+		Predicate: "before",
+		Objects: []string{
+			fmt.Sprintf("%d", now.Unix()),
+		},
+	}
+
+	user := NewUser().WithTime("datetime", now.Add(-time.Second))
+	r := condition.meet(user, nil)
+	assert.True(t, r)
+
+	user = NewUser().WithTime("datetime", now)
+	r = condition.meet(user, nil)
+	assert.False(t, r)
+
+	user = NewUser().WithNumber("datetime", float64(now.Unix()-1))
+	r = condition.meet(user, nil)
+	assert.True(t, r)
+}
+
+func TestListAttribute(t *testing.T) {
+	condition := Condition{
+		Type:      "string",
+		Subject:   "groups",
+		Predicate: "is one of",
+		Objects: []string{
+			"beta", "staff",
+		},
+	}
+
+	user := NewUser().WithList("groups", []string{"users", "staff"})
+	r := condition.meet(user, nil)
+	assert.True(t, r)
+
+	user = NewUser().WithList("groups", []string{"users"})
+	r = condition.meet(user, nil)
+	assert.False(t, r)
+
+	user = NewUser().WithList("groups", []string{})
+	r = condition.meet(user, nil)
+	assert.False(t, r)
+
+	condition.Predicate = "is not any of"
+	user = NewUser().WithList("groups", []string{"users", "staff"})
+	r = condition.meet(user, nil)
+	assert.False(t, r)
+
+	user = NewUser().WithList("groups", []string{"users"})
+	r = condition.meet(user, nil)
+	assert.True(t, r)
+}
+
+func TestListAttributeNumberAndSemVer(t *testing.T) {
+	condition := Condition{
+		Type:      "number",
+		Subject:   "scores",
+		Predicate: ">",
+		Objects: []string{
+			"10",
+		},
+	}
+
+	user := NewUser().WithList("scores", []string{"a", "5", "11"})
+	r := condition.meet(user, nil)
+	assert.True(t, r)
+
+	user = NewUser().WithList("scores", []string{"5", "10"})
+	r = condition.meet(user, nil)
+	assert.False(t, r)
+
+	condition = Condition{
+		Type:      "semver",
+		Subject:   "versions",
+		Predicate: "!=",
+		Objects: []string{
+			"1.0.0",
+		},
+	}
+
+	user = NewUser().WithList("versions", []string{"1.0.0", "2.0.0"})
+	r = condition.meet(user, nil)
+	assert.False(t, r)
+
+	user = NewUser().WithList("versions", []string{"1.1.0", "2.0.0"})
+	r = condition.meet(user, nil)
+	assert.True(t, r)
+}
+
+func TestContextCondition(t *testing.T) {
+	condition := Condition{
+		Type:      "string",
+		Subject:   "organization.plan",
+		Predicate: "is one of",
+		Objects: []string{
+			"enterprise",
+		},
+	}
+
+	organization := NewUser().StableRollout("org1").With("plan", "enterprise")
+	user := NewUser().With("plan", "free").WithContext("organization", organization)
+	r := condition.meet(user, nil)
+	assert.True(t, r)
+
+	user = NewUser().With("plan", "enterprise")
+	r = condition.meet(user, nil)
+	assert.False(t, r)
+
+	user = NewUser().With("organization.plan", "enterprise")
+	r = condition.meet(user, nil)
+	assert.True(t, r)
+
+	condition.Subject = "user.plan"
+	user = NewUser().With("plan", "enterprise").WithContext("organization", NewUser().With("plan", "free"))
+	r = condition.meet(user, nil)
+	assert.True(t, r)
+
+	condition = Condition{
+		Type:      "number",
+		Subject:   "device.battery",
+		Predicate: "<",
+		Objects: []string{
+			"20",
+		},
+	}
+	user = NewUser().WithContext("device", NewUser().WithNumber("battery", 15))
+	r = condition.meet(user, nil)
+	assert.True(t, r)
+}
+
+func TestIgnoreCase(t *testing.T) {
+	condition := Condition{
+		Type:       "string",
+		Subject:    "country",
+		Predicate:  "is one of",
+		Objects:    []string{"Germany", "STRASSE"},
+		IgnoreCase: true,
+	}
+	compiled := condition
+	compiled.compiled = compileCondition(condition)
+
+	for _, c := range []Condition{condition, compiled} {
+		assert.True(t, c.meet(NewUser().With("country", "germany"), nil))
+		assert.True(t, c.meet(NewUser().With("country", "strasse"), nil))
+		assert.False(t, c.meet(NewUser().With("country", "france"), nil))
+
+		c.Predicate = "is not any of"
+		assert.False(t, c.meet(NewUser().With("country", "GERMANY"), nil))
+		assert.True(t, c.meet(NewUser().With("country", "france"), nil))
+
+		c.Predicate = "starts with"
+		assert.True(t, c.meet(NewUser().With("country", "GERMANY-east"), nil))
+
+		c.Predicate = "does not contain"
+		assert.False(t, c.meet(NewUser().With("country", "East germany"), nil))
+	}
+
+	condition.IgnoreCase = false
+	assert.False(t, condition.meet(NewUser().With("country", "germany"), nil))
+}
+
+func TestNormalize(t *testing.T) {
+	composed, decomposed := "caf\u00e9", "cafe\u0301"
+	condition := Condition{
+		Type:      "string",
+		Subject:   "name",
+		Predicate: "is one of",
+		Objects:   []string{composed},
+	}
+	assert.False(t, condition.meet(NewUser().With("name", decomposed), nil))
+
+	condition.Normalize = true
+	assert.True(t, condition.meet(NewUser().With("name", decomposed), nil))
+	condition.compiled = compileCondition(condition)
+	assert.True(t, condition.meet(NewUser().With("name", decomposed), nil))
+
+	condition.Predicate = "matches regex"
+	condition.Objects = []string{"^" + decomposed + "$"}
+	condition.compiled = nil
+	assert.True(t, condition.meet(NewUser().With("name", composed), nil))
+}
+
+func TestRegexFlags(t *testing.T) {
+	condition := Condition{
+		Type:      "string",
+		Subject:   "bio",
+		Predicate: "matches regex",
+		Objects:   []string{"^admin$"},
+	}
+	user := NewUser().With("bio", "guest\nADMIN")
+	assert.False(t, condition.meet(user, nil))
+
+	condition.RegexFlags = "m"
+	assert.False(t, condition.meet(user, nil))
+
+	condition.IgnoreCase = true
+	assert.True(t, condition.meet(user, nil))
+	condition.compiled = compileCondition(condition)
+	assert.True(t, condition.meet(user, nil))
+
+	condition.Predicate = "does not match regex"
+	assert.False(t, condition.meet(user, nil))
+}
+
+func TestListIgnoreCase(t *testing.T) {
+	condition := Condition{
+		Type:       "list",
+		Subject:    "roles",
+		Predicate:  "contains all",
+		Objects:    []string{"Admin", "Editor"},
+		IgnoreCase: true,
+	}
+	user := NewUser().WithList("roles", []string{"admin", "EDITOR"})
+	assert.True(t, condition.meet(user, nil))
+	condition.compiled = compileCondition(condition)
+	assert.True(t, condition.meet(user, nil))
+}
+
 func TestUnknownConditionType(t *testing.T) {
 	c := Condition{
 		Type:      "unknown",
@@ -1282,3 +1864,129 @@ func TestClearRepo(t *testing.T) {
 	assert.Equal(t, 0, len(repo.getSegments()))
 	assert.Equal(t, 0, len(repo.getToggles()))
 }
+
+func TestMemoryStore(t *testing.T) {
+	repo, _ := loadRepoFromFile()
+	store := repo.Store()
+	version := store.Version()
+
+	toggle, ok := store.Get("bool_toggle")
+	assert.True(t, ok)
+
+	toggle.Version = 0
+	toggle.Enabled = false
+	store.Upsert(toggle)
+	stored, _ := store.Get("bool_toggle")
+	assert.True(t, stored.Enabled)
+	assert.Equal(t, version, store.Version())
+
+	toggle.Version = 100
+	store.Upsert(toggle)
+	stored, _ = store.Get("bool_toggle")
+	assert.False(t, stored.Enabled)
+	assert.Equal(t, version+1, store.Version())
+
+	total := len(store.All())
+	store.Delete("bool_toggle")
+	_, ok = store.Get("bool_toggle")
+	assert.False(t, ok)
+	assert.Equal(t, total-1, len(store.All()))
+	assert.Equal(t, version+2, store.Version())
+}
+
+type countingStore struct {
+	*MemoryStore
+	gets int
+}
+
+func (c *countingStore) Get(key string) (Toggle, bool) {
+	c.gets++
+	return c.MemoryStore.Get(key)
+}
+
+func TestCustomToggleStore(t *testing.T) {
+	store := &countingStore{MemoryStore: NewMemoryStore()}
+	repo := NewRepository(store)
+	bytes, _ := ioutil.ReadFile("./resources/fixtures/repo.json")
+	repoData := RepositoryData{}
+	_ = json.Unmarshal(bytes, &repoData)
+	repo.flush(repoData)
+
+	fp := FeatureProbe{Repo: repo, Config: FPConfig{MaxPrerequisitesDeep: 5}}
+	user := NewUser().StableRollout("key11").With("city", "4")
+	assert.Equal(t, "2", fp.StrValue("string_toggle", user, "1"))
+	assert.Equal(t, 1, store.gets)
+	assert.Equal(t, uint64(1), store.Version())
+}
+
+func TestTargetMatch(t *testing.T) {
+	var toggle Toggle
+	jsonStr := `
+		{
+            "key": "target_toggle",
+            "enabled": true,
+            "version": 1,
+            "disabledServe": {
+                "select": 0
+            },
+            "defaultServe": {
+                "select": 0
+            },
+            "targets": [
+                {
+                    "variation": 1,
+                    "keys": ["user_1", "user_2"]
+                },
+                {
+                    "variation": 2,
+                    "keys": ["user_3"]
+                }
+            ],
+            "rules": [
+                {
+                    "serve": {
+                        "select": 0
+                    },
+                    "conditions": [
+                        {
+                            "type": "string",
+                            "subject": "city",
+                            "predicate": "is one of",
+                            "objects": ["1"]
+                        }
+                    ]
+                }
+            ],
+            "variations": ["a", "b", "c"]
+        }`
+	err := json.Unmarshal([]byte(jsonStr), &toggle)
+	assert.Empty(t, err)
+	assert.Equal(t, 2, len(toggle.Targets[0].keySet))
+
+	user := NewUser().StableRollout("user_2").With("city", "1")
+	detail, err := toggle.evalDetail(user, nil, nil, nil, 10)
+	assert.Empty(t, err)
+	assert.Equal(t, "b", detail.Value)
+	assert.Equal(t, 1, *detail.VariationIndex)
+	assert.Nil(t, detail.RuleIndex)
+	assert.Equal(t, ReasonTargetMatch, detail.Reason)
+
+	user = NewUser().StableRollout("user_3")
+	detail, _ = toggle.evalDetail(user, nil, nil, nil, 10)
+	assert.Equal(t, "c", detail.Value)
+
+	user = NewUser().StableRollout("user_4").With("city", "1")
+	detail, _ = toggle.evalDetail(user, nil, nil, nil, 10)
+	assert.Equal(t, "a", detail.Value)
+	assert.Equal(t, 0, *detail.RuleIndex)
+}
+
+func TestTargetWithoutKeySet(t *testing.T) {
+	target := Target{Variation: 0, Keys: []string{"user_1"}}
+	assert.True(t, target.contains("user_1"))
+	assert.False(t, target.contains("user_2"))
+
+	targets := compileTargets([]Target{target})
+	assert.Equal(t, 1, len(targets[0].keySet))
+	assert.Nil(t, target.keySet)
+}
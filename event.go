@@ -11,6 +11,9 @@ import (
 
 type EventRecorder struct {
 	auth           string
+	headers        http.Header
+	userAgent      string
+	clock          Clock
 	eventsUrl      string
 	flushInterval  time.Duration
 	incomingEvents []interface{}
@@ -32,6 +35,16 @@ type AccessEvent struct {
 	Value          interface{} `json:"value"`
 	VariationIndex *int        `json:"variationIndex"`
 	Version        *uint64     `json:"version"`
+	// Contexts holds the key of each context attached to the user by kind.
+	Contexts map[string]string `json:"contexts,omitempty"`
+	// Anonymous is set when User is a generated key.
+	Anonymous bool `json:"anonymous,omitempty"`
+	// ExperimentId and InExperiment tell the experiment of the split which
+	// served Value and whether the user is in it.
+	ExperimentId string `json:"experimentId,omitempty"`
+	InExperiment bool   `json:"inExperiment,omitempty"`
+	// Layer is the experiment layer the user is in through Key.
+	Layer string `json:"layer,omitempty"`
 }
 
 type DebugEvent struct {
@@ -45,6 +58,10 @@ type DebugEvent struct {
 	RuleIndex      *int                   `json:"ruleIndex"`
 	Version        *uint64                `json:"version"`
 	Reason         string                 `json:"reason"`
+	// RedactedAttributes lists the private attributes left out of UserDetail.
+	RedactedAttributes []string `json:"redactedAttributes,omitempty"`
+	// Anonymous is set when User is a generated key.
+	Anonymous bool `json:"anonymous,omitempty"`
 }
 
 type CustomEvent struct {
@@ -53,6 +70,10 @@ type CustomEvent struct {
 	User  string   `json:"user"`
 	Name  string   `json:"name"`
 	Value *float64 `json:"value"`
+	// Contexts holds the key of each context attached to the user by kind.
+	Contexts map[string]string `json:"contexts,omitempty"`
+	// Anonymous is set when User is a generated key.
+	Anonymous bool `json:"anonymous,omitempty"`
 }
 
 type PackedData struct {
@@ -84,9 +105,11 @@ type CountValue struct {
 	Value interface{} `json:"value"`
 }
 
-func NewEventRecorder(eventsUrl string, flushInterval time.Duration, auth string) EventRecorder {
-	return EventRecorder{
+func NewEventRecorder(eventsUrl string, flushInterval time.Duration, auth string) *EventRecorder {
+	return &EventRecorder{
 		auth:           auth,
+		userAgent:      USER_AGENT,
+		clock:          systemClock{},
 		eventsUrl:      eventsUrl,
 		flushInterval:  flushInterval,
 		incomingEvents: []interface{}{},
@@ -146,9 +169,8 @@ func (e *EventRecorder) doFlush() {
 		fmt.Printf("%s\n", err)
 		return
 	}
-	req.Header.Add("Authorization", e.auth)
+	setRequestHeaders(req, e.headers, e.auth, e.userAgent)
 	req.Header.Set("Content-Type", "application/json")
-	req.Header.Add("User-Agent", USER_AGENT)
 	_, err = e.httpClient.Do(req)
 	if err != nil {
 		fmt.Printf("Report event fails: %s\n", err)
@@ -156,14 +178,14 @@ func (e *EventRecorder) doFlush() {
 }
 
 func (e *EventRecorder) buildPackedData(events []interface{}) []PackedData {
-	e.access.EndTime = time.Now().UnixNano() / 1e6
+	e.access.EndTime = unixMilli(e.clock.Now())
 	p := PackedData{Access: e.access, Events: events}
 	return []PackedData{p}
 }
 
 func (e *EventRecorder) addAccess(event AccessEvent) {
 	if len(e.access.Counters) == 0 {
-		e.access.StartTime = time.Now().UnixNano() / 1e6
+		e.access.StartTime = unixMilli(e.clock.Now())
 	}
 	counters, ok := e.access.Counters[event.Key]
 	if ok {
@@ -2,6 +2,7 @@ package featureprobe
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
 	socketio "github.com/socket-iox/socket-io-client-go"
 	"net"
@@ -11,8 +12,8 @@ import (
 	"time"
 )
 
-var VERSION string = "1.1.0"
-var USER_AGENT string = "Go/" + VERSION
+const VERSION = "1.1.0"
+const USER_AGENT = "Go/" + VERSION
 
 type FeatureProbe struct {
 	Config   FPConfig
@@ -20,6 +21,8 @@ type FeatureProbe struct {
 	Syncer   *Synchronizer
 	Socket   *socketio.Client
 	Recorder *EventRecorder
+
+	segmentMemberships *segmentMembershipCache
 }
 
 type FPConfig struct {
@@ -32,37 +35,110 @@ type FPConfig struct {
 	StartWait            time.Duration
 	Repo                 *Repository
 	MaxPrerequisitesDeep int
+	// HttpClient is used as is for toggles and events requests when set,
+	// including the toggles fetch triggered by a realtime update.
+	//
+	// The socket.io client dials the realtime socket on its own and can't use
+	// HttpClient, Transport, TLSConfig or Proxy, so setting any of them turns
+	// realtime updates off and toggles are refreshed every RefreshInterval.
+	HttpClient *http.Client
+	// Transport replaces the default transport, ignored when HttpClient is set.
+	Transport http.RoundTripper
+	// TLSConfig and Proxy customize the default transport, ignored when
+	// HttpClient or Transport is set.
+	TLSConfig *tls.Config
+	Proxy     func(*http.Request) (*url.URL, error)
+	// DisableRealtime doesn't connect to realtime updates, toggles are only
+	// refreshed every RefreshInterval. Realtime updates are also off in
+	// DaemonMode and with a custom HttpClient, Transport, TLSConfig or Proxy.
+	DisableRealtime bool
+	// Headers are added to every toggles and events request. They are not
+	// sent on the realtime socket handshake, whose headers the socket.io
+	// client doesn't let callers set, see DisableRealtime.
+	Headers http.Header
+	// WrapperName and WrapperVersion identify a wrapper library built on top
+	// of this SDK, they are appended to the User-Agent header of toggles and
+	// events requests, not of the realtime socket handshake.
+	WrapperName    string
+	WrapperVersion string
+	// ToggleStore replaces the default in-memory store of synced toggles.
+	ToggleStore ToggleStore
+	// DataStore writes synced toggles through to an external store shared with
+	// other instances, evaluations read an in-memory copy. Ignored when
+	// ToggleStore is set, unless in DaemonMode.
+	DataStore DataStore
+	// DaemonMode only reads toggles from DataStore every RefreshInterval,
+	// without polling the FeatureProbe server or connecting to realtime
+	// updates. The toggles read are kept in ToggleStore, in memory by default,
+	// and never written back. Without a DataStore the client is never
+	// initialized.
+	DaemonMode bool
+	// PrivateAttributes are redacted from events, use "kind.attribute" for the
+	// attributes of attached contexts.
+	PrivateAttributes []string
+	// AllAttributesPrivate redacts every attribute from events, keys are kept.
+	AllAttributesPrivate bool
+	// Clock replaces the system clock, e.g. to test scheduled rollouts.
+	Clock Clock
+	// SegmentMembershipStore looks up the users of unbounded segments.
+	SegmentMembershipStore SegmentMembershipStore
+	// SegmentMembershipCacheTTL is how long the membership of a user is
+	// cached, 5 seconds by default.
+	SegmentMembershipCacheTTL time.Duration
+	// SegmentMembershipStaleAfter is how long after its last update the
+	// SegmentMembershipStore is considered stale, 2 minutes by default.
+	SegmentMembershipStaleAfter time.Duration
 }
 
 type FPBoolDetail struct {
-	Value     bool
-	RuleIndex *int
-	Version   *uint64
-	Reason    string
+	Value                  bool
+	RuleIndex              *int
+	Version                *uint64
+	Reason                 string
+	SegmentMembershipStale bool
+	ExperimentId           string
+	InExperiment           bool
+	Holdout                string
+	Layer                  string
 }
 
 type FPNumberDetail struct {
-	Value     float64
-	RuleIndex *int
-	Version   *uint64
-	Reason    string
+	Value                  float64
+	RuleIndex              *int
+	Version                *uint64
+	Reason                 string
+	SegmentMembershipStale bool
+	ExperimentId           string
+	InExperiment           bool
+	Holdout                string
+	Layer                  string
 }
 
 type FPStrDetail struct {
-	Value     string
-	RuleIndex *int
-	Version   *uint64
-	Reason    string
+	Value                  string
+	RuleIndex              *int
+	Version                *uint64
+	Reason                 string
+	SegmentMembershipStale bool
+	ExperimentId           string
+	InExperiment           bool
+	Holdout                string
+	Layer                  string
 }
 
 type FPJsonDetail struct {
-	Value     interface{}
-	RuleIndex *int
-	Version   *uint64
-	Reason    string
+	Value                  interface{}
+	RuleIndex              *int
+	Version                *uint64
+	Reason                 string
+	SegmentMembershipStale bool
+	ExperimentId           string
+	InExperiment           bool
+	Holdout                string
+	Layer                  string
 }
 
-func NewFeatureProbe(config FPConfig) FeatureProbe {
+func NewFeatureProbe(config FPConfig) *FeatureProbe {
 	defer func() {
 		if recoveredError := recover(); recoveredError != nil {
 			fmt.Printf("FP encountered an unknown error: %s\n", recoveredError)
@@ -71,41 +147,58 @@ func NewFeatureProbe(config FPConfig) FeatureProbe {
 
 	ready := make(chan struct{}, 1)
 	setServerUrls(&config)
+	if config.Clock == nil {
+		config.Clock = systemClock{}
+	}
 	timeout := config.RefreshInterval
 	eventRecorder := NewEventRecorder(config.EventsUrl, timeout, config.ServerSdkKey)
+	eventRecorder.clock = config.Clock
+	eventRecorder.httpClient = config.newHttpClient(timeout)
+	eventRecorder.headers = config.Headers.Clone()
+	eventRecorder.userAgent = config.userAgent()
 	eventRecorder.Start()
 
 	//setup realtime connection
 	u, err := url.Parse(config.RealtimeUrl)
 	var socket *socketio.Client
-	if err == nil {
+	if err == nil && config.realtimeEnabled() {
 		s := socketio.Client{NameSpace: &u.Path}
 		socket = &s
 	}
 
 	ctx, cancelFunc := context.WithTimeout(context.Background(), config.StartWait)
 	defer cancelFunc()
-	toggleSyncer := Synchronizer{}
-	repo := Repository{}
-	if config.Repo == nil {
-		toggleSyncer = NewSynchronizer(config.TogglesUrl, config.RefreshInterval, config.ServerSdkKey, &repo)
-	} else {
-		repo = *config.Repo
+	var toggleSyncer *Synchronizer
+	var repo *Repository
+	if config.Repo != nil {
+		repo = config.Repo
 		toggleSyncer = NewCustomRepoSynchronizer(config.Repo)
+	} else if config.DaemonMode {
+		repo = NewRepository(config.ToggleStore)
+		toggleSyncer = NewDataStoreSynchronizer(config.DataStore, config.RefreshInterval, repo)
+	} else {
+		repo = config.newRepository()
+		toggleSyncer = NewSynchronizer(config.TogglesUrl, config.RefreshInterval, config.ServerSdkKey, repo)
+		toggleSyncer.httpClient = config.newHttpClient(config.RefreshInterval)
+		toggleSyncer.headers = config.Headers.Clone()
+		toggleSyncer.userAgent = config.userAgent()
 	}
 	toggleSyncer.Start(ready)
 	if config.MaxPrerequisitesDeep == 0 {
 		config.MaxPrerequisitesDeep = 20
 	}
-	client := FeatureProbe{
-		Config:   config,
-		Repo:     &repo,
-		Syncer:   &toggleSyncer,
-		Recorder: &eventRecorder,
-		Socket:   socket,
+	client := &FeatureProbe{
+		Config:             config,
+		Repo:               repo,
+		Syncer:             toggleSyncer,
+		Recorder:           eventRecorder,
+		Socket:             socket,
+		segmentMemberships: newSegmentMembershipCache(config),
 	}
 
-	go client.connectSocket()
+	if socket != nil {
+		go client.connectSocket()
+	}
 
 	if config.StartWait > 0 {
 		for {
@@ -123,6 +216,16 @@ func NewFeatureProbe(config FPConfig) FeatureProbe {
 	return client
 }
 
+func (config *FPConfig) newRepository() *Repository {
+	if config.ToggleStore != nil {
+		return NewRepository(config.ToggleStore)
+	}
+	if config.DataStore != nil {
+		return newDataStoreRepository(config.DataStore)
+	}
+	return NewRepository(nil)
+}
+
 func setServerUrls(config *FPConfig) {
 	if !strings.HasSuffix(config.RemoteUrl, "/") {
 		config.RemoteUrl += "/"
@@ -152,20 +255,20 @@ func newToggleForTest(key string, value interface{}) Toggle {
 	}
 }
 
-func NewFeatureProbeForTest(toggles map[string]interface{}) FeatureProbe {
+func NewFeatureProbeForTest(toggles map[string]interface{}) *FeatureProbe {
 	repoData := RepositoryData{}
 	repoData.Toggles = map[string]Toggle{}
 	for key, value := range toggles {
 		repoData.Toggles[key] = newToggleForTest(key, value)
 	}
-	repo := Repository{}
+	repo := &Repository{}
 	repo.flush(repoData)
-	return FeatureProbe{
-		Repo: &repo,
+	return &FeatureProbe{
+		Repo: repo,
 	}
 }
 
-func (fp *FeatureProbe) BoolValue(toggle string, user FPUser, defaultValue bool) (result bool) {
+func (fp *FeatureProbe) BoolValue(toggle string, user FPUser, defaultValue bool, opts ...EvalOption) (result bool) {
 	defer func() {
 		if recoveredError := recover(); recoveredError != nil {
 			fmt.Printf("FP encountered an unknown error: %s\n", recoveredError)
@@ -173,7 +276,7 @@ func (fp *FeatureProbe) BoolValue(toggle string, user FPUser, defaultValue bool)
 		}
 	}()
 
-	val, _, _, _ := fp.genericDetail(toggle, user, defaultValue)
+	val := fp.genericDetail(toggle, user, defaultValue, opts...).Value
 	result, ok := val.(bool)
 	if !ok {
 		result = defaultValue
@@ -181,7 +284,7 @@ func (fp *FeatureProbe) BoolValue(toggle string, user FPUser, defaultValue bool)
 	return
 }
 
-func (fp *FeatureProbe) StrValue(toggle string, user FPUser, defaultValue string) (result string) {
+func (fp *FeatureProbe) StrValue(toggle string, user FPUser, defaultValue string, opts ...EvalOption) (result string) {
 	defer func() {
 		if recoveredError := recover(); recoveredError != nil {
 			fmt.Printf("FP encountered an unknown error: %s\n", recoveredError)
@@ -189,7 +292,7 @@ func (fp *FeatureProbe) StrValue(toggle string, user FPUser, defaultValue string
 		}
 	}()
 
-	val, _, _, _ := fp.genericDetail(toggle, user, defaultValue)
+	val := fp.genericDetail(toggle, user, defaultValue, opts...).Value
 	result, ok := val.(string)
 	if !ok {
 		result = defaultValue
@@ -197,7 +300,7 @@ func (fp *FeatureProbe) StrValue(toggle string, user FPUser, defaultValue string
 	return
 }
 
-func (fp *FeatureProbe) NumberValue(toggle string, user FPUser, defaultValue float64) (result float64) {
+func (fp *FeatureProbe) NumberValue(toggle string, user FPUser, defaultValue float64, opts ...EvalOption) (result float64) {
 	defer func() {
 		if recoveredError := recover(); recoveredError != nil {
 			fmt.Printf("FP encountered an unknown error: %s\n", recoveredError)
@@ -205,7 +308,7 @@ func (fp *FeatureProbe) NumberValue(toggle string, user FPUser, defaultValue flo
 		}
 	}()
 
-	val, _, _, _ := fp.genericDetail(toggle, user, defaultValue)
+	val := fp.genericDetail(toggle, user, defaultValue, opts...).Value
 	i, ok := val.(int)
 	if ok {
 		result = float64(i)
@@ -217,7 +320,7 @@ func (fp *FeatureProbe) NumberValue(toggle string, user FPUser, defaultValue flo
 	return
 }
 
-func (fp *FeatureProbe) JsonValue(toggle string, user FPUser, defaultValue interface{}) (result interface{}) {
+func (fp *FeatureProbe) JsonValue(toggle string, user FPUser, defaultValue interface{}, opts ...EvalOption) (result interface{}) {
 	defer func() {
 		if recoveredError := recover(); recoveredError != nil {
 			fmt.Printf("FP encountered an unknown error: %s\n", recoveredError)
@@ -225,7 +328,7 @@ func (fp *FeatureProbe) JsonValue(toggle string, user FPUser, defaultValue inter
 		}
 	}()
 
-	result, _, _, _ = fp.genericDetail(toggle, user, defaultValue)
+	result = fp.genericDetail(toggle, user, defaultValue, opts...).Value
 	return
 }
 
@@ -237,44 +340,76 @@ func (fp *FeatureProbe) Track(eventName string, user FPUser, value *float64) {
 	}()
 
 	if fp.Recorder != nil {
+		user = user.withAnonymousKey()
 		fp.Recorder.RecordCustom(CustomEvent{
-			Kind:  "custom",
-			Time:  time.Now().UnixNano() / 1e6,
-			User:  user.Key(),
-			Name:  eventName,
-			Value: value,
+			Kind:      "custom",
+			Time:      unixMilli(fp.now()),
+			User:      user.Key(),
+			Name:      eventName,
+			Value:     value,
+			Contexts:  user.ContextKeys(),
+			Anonymous: user.Anonymous(),
 		})
 	}
 }
 
-func (fp *FeatureProbe) genericDetail(toggle string, user FPUser, defaultValue interface{}) (interface{}, *int, *uint64, string) {
-	reason := fmt.Sprintf("Toggle:[%s] not exist", toggle)
-	var ruleIndex *int = nil
-	var version *uint64 = nil
-	var variationIndex *int = nil
-
+func (fp *FeatureProbe) genericDetail(toggle string, user FPUser, defaultValue interface{},
+	opts ...EvalOption) EvalDetail {
+	notExist := EvalDetail{Value: defaultValue, Reason: fmt.Sprintf("Toggle:[%s] not exist", toggle)}
 	if fp.Repo == nil {
-		return defaultValue, ruleIndex, version, reason
+		return notExist
 	}
 	t, ok := fp.Repo.getToggle(toggle)
 	if !ok {
-		return defaultValue, ruleIndex, version, reason
+		return notExist
 	}
-	detail, _ := t.evalDetail(user, fp.Repo.getToggles(), fp.Repo.getSegments(), defaultValue, fp.Config.MaxPrerequisitesDeep)
-
-	variationIndex = detail.VariationIndex
-	ruleIndex = detail.RuleIndex
-	version = detail.Version
-	reason = detail.Reason
+	user = user.withAnonymousKey()
+	detail := fp.evaluate(t, user, defaultValue, opts...)
 
-	if fp.Recorder != nil && variationIndex != nil {
+	if fp.Recorder != nil && detail.VariationIndex != nil {
 		fp.trackEvent(t, user, detail)
 	}
-	return detail.Value, ruleIndex, version, reason
+	return detail
+}
+
+// evaluate evaluates toggle for user without recording events.
+func (fp *FeatureProbe) evaluate(toggle Toggle, user FPUser, defaultValue interface{}, opts ...EvalOption) EvalDetail {
+	options := evalOptions{}
+	for _, opt := range opts {
+		opt(&options)
+	}
+	evalTime := options.asOf
+	if evalTime.IsZero() {
+		evalTime = fp.now()
+	}
+	memberships := &segmentMembershipLookup{cache: fp.segmentMemberships, userKey: user.Key()}
+	evalUser := user.at(evalTime).withSegmentMemberships(memberships)
+	detail, _ := toggle.evalDetail(evalUser, fp.Repo.getToggles(), fp.Repo.getSegments(), defaultValue,
+		fp.Config.MaxPrerequisitesDeep)
+	detail.SegmentMembershipStale = memberships.stale
+	return detail
+}
+
+// ExplainSplit evaluates toggleKey for user, without recording events, and
+// explains how the split which served the value bucketed the user. ok is false
+// when the toggle does not exist or its value was not served by a split.
+func (fp *FeatureProbe) ExplainSplit(toggleKey string, user FPUser, opts ...EvalOption) (SplitExplanation, bool) {
+	if fp.Repo == nil {
+		return SplitExplanation{}, false
+	}
+	t, ok := fp.Repo.getToggle(toggleKey)
+	if !ok {
+		return SplitExplanation{}, false
+	}
+	detail := fp.evaluate(t, user.withAnonymousKey(), nil, opts...)
+	if detail.split == nil {
+		return SplitExplanation{}, false
+	}
+	return *detail.split, true
 }
 
 func (fp *FeatureProbe) trackEvent(toggle Toggle, user FPUser, evalDetail EvalDetail) {
-	nowTime := time.Now().UnixNano() / 1e6
+	nowTime := unixMilli(fp.now())
 	fp.Recorder.RecordAccess(AccessEvent{
 		Kind:           "access",
 		Time:           nowTime,
@@ -283,25 +418,33 @@ func (fp *FeatureProbe) trackEvent(toggle Toggle, user FPUser, evalDetail EvalDe
 		Value:          evalDetail.Value,
 		VariationIndex: evalDetail.VariationIndex,
 		Version:        evalDetail.Version,
-	}, toggle.TrackAccessEvents)
+		Contexts:       user.ContextKeys(),
+		Anonymous:      user.Anonymous(),
+		ExperimentId:   evalDetail.ExperimentId,
+		InExperiment:   evalDetail.InExperiment,
+		Layer:          evalDetail.Layer,
+	}, toggle.TrackAccessEvents || evalDetail.InExperiment)
 
 	if fp.Repo.getDebugUntilTime() > 0 && fp.Repo.getDebugUntilTime() >= uint64(nowTime) {
+		userDetail, redacted := user.redactedMap(fp.Config.PrivateAttributes, fp.Config.AllAttributesPrivate)
 		fp.Recorder.RecordDebugAccess(DebugEvent{
-			Kind:           "debug",
-			Time:           nowTime,
-			User:           user.Key(),
-			Key:            toggle.Key,
-			UserDetail:     user.ToMap(),
-			Value:          evalDetail.Value,
-			VariationIndex: evalDetail.VariationIndex,
-			RuleIndex:      evalDetail.RuleIndex,
-			Version:        evalDetail.Version,
-			Reason:         evalDetail.Reason,
+			Kind:               "debug",
+			Time:               nowTime,
+			User:               user.Key(),
+			Key:                toggle.Key,
+			UserDetail:         userDetail,
+			Value:              evalDetail.Value,
+			VariationIndex:     evalDetail.VariationIndex,
+			RuleIndex:          evalDetail.RuleIndex,
+			Version:            evalDetail.Version,
+			Reason:             evalDetail.Reason,
+			RedactedAttributes: redacted,
+			Anonymous:          user.Anonymous(),
 		})
 	}
 }
 
-func (fp *FeatureProbe) BoolDetail(toggle string, user FPUser, defaultValue bool) (result FPBoolDetail) {
+func (fp *FeatureProbe) BoolDetail(toggle string, user FPUser, defaultValue bool, opts ...EvalOption) (result FPBoolDetail) {
 	defer func() {
 		if recoveredError := recover(); recoveredError != nil {
 			fmt.Printf("FP encountered an unknown error: %s\n", recoveredError)
@@ -309,10 +452,12 @@ func (fp *FeatureProbe) BoolDetail(toggle string, user FPUser, defaultValue bool
 		}
 	}()
 
-	value, ruleIndex, version, reason := fp.genericDetail(toggle, user, defaultValue)
-	result = FPBoolDetail{Value: defaultValue, RuleIndex: ruleIndex, Version: version, Reason: reason}
+	detail := fp.genericDetail(toggle, user, defaultValue, opts...)
+	result = FPBoolDetail{Value: defaultValue, RuleIndex: detail.RuleIndex, Version: detail.Version, Reason: detail.Reason,
+		SegmentMembershipStale: detail.SegmentMembershipStale, ExperimentId: detail.ExperimentId,
+		InExperiment: detail.InExperiment, Holdout: detail.Holdout, Layer: detail.Layer}
 
-	val, ok := value.(bool)
+	val, ok := detail.Value.(bool)
 	if !ok {
 		result.Reason = "Value type mismatch"
 		return
@@ -321,7 +466,7 @@ func (fp *FeatureProbe) BoolDetail(toggle string, user FPUser, defaultValue bool
 	return
 }
 
-func (fp *FeatureProbe) StrDetail(toggle string, user FPUser, defaultValue string) (result FPStrDetail) {
+func (fp *FeatureProbe) StrDetail(toggle string, user FPUser, defaultValue string, opts ...EvalOption) (result FPStrDetail) {
 	defer func() {
 		if recoveredError := recover(); recoveredError != nil {
 			fmt.Printf("FP encountered an unknown error: %s\n", recoveredError)
@@ -329,10 +474,12 @@ func (fp *FeatureProbe) StrDetail(toggle string, user FPUser, defaultValue strin
 		}
 	}()
 
-	value, ruleIndex, version, reason := fp.genericDetail(toggle, user, defaultValue)
-	result = FPStrDetail{Value: defaultValue, RuleIndex: ruleIndex, Version: version, Reason: reason}
+	detail := fp.genericDetail(toggle, user, defaultValue, opts...)
+	result = FPStrDetail{Value: defaultValue, RuleIndex: detail.RuleIndex, Version: detail.Version, Reason: detail.Reason,
+		SegmentMembershipStale: detail.SegmentMembershipStale, ExperimentId: detail.ExperimentId,
+		InExperiment: detail.InExperiment, Holdout: detail.Holdout, Layer: detail.Layer}
 
-	val, ok := value.(string)
+	val, ok := detail.Value.(string)
 	if !ok {
 		result.Reason = "Value type mismatch"
 		return
@@ -341,7 +488,7 @@ func (fp *FeatureProbe) StrDetail(toggle string, user FPUser, defaultValue strin
 	return
 }
 
-func (fp *FeatureProbe) NumberDetail(toggle string, user FPUser, defaultValue float64) (result FPNumberDetail) {
+func (fp *FeatureProbe) NumberDetail(toggle string, user FPUser, defaultValue float64, opts ...EvalOption) (result FPNumberDetail) {
 	defer func() {
 		if recoveredError := recover(); recoveredError != nil {
 			fmt.Printf("FP encountered an unknown error: %s\n", recoveredError)
@@ -349,10 +496,12 @@ func (fp *FeatureProbe) NumberDetail(toggle string, user FPUser, defaultValue fl
 		}
 	}()
 
-	value, ruleIndex, version, reason := fp.genericDetail(toggle, user, defaultValue)
-	result = FPNumberDetail{Value: defaultValue, RuleIndex: ruleIndex, Version: version, Reason: reason}
+	detail := fp.genericDetail(toggle, user, defaultValue, opts...)
+	result = FPNumberDetail{Value: defaultValue, RuleIndex: detail.RuleIndex, Version: detail.Version, Reason: detail.Reason,
+		SegmentMembershipStale: detail.SegmentMembershipStale, ExperimentId: detail.ExperimentId,
+		InExperiment: detail.InExperiment, Holdout: detail.Holdout, Layer: detail.Layer}
 
-	val, ok := value.(float64)
+	val, ok := detail.Value.(float64)
 	if !ok {
 		result.Reason = "Value type mismatch"
 		return
@@ -361,7 +510,7 @@ func (fp *FeatureProbe) NumberDetail(toggle string, user FPUser, defaultValue fl
 	return
 }
 
-func (fp *FeatureProbe) JsonDetail(toggle string, user FPUser, defaultValue interface{}) (result FPJsonDetail) {
+func (fp *FeatureProbe) JsonDetail(toggle string, user FPUser, defaultValue interface{}, opts ...EvalOption) (result FPJsonDetail) {
 	defer func() {
 		if recoveredError := recover(); recoveredError != nil {
 			fmt.Printf("FP encountered an unknown error: %s\n", recoveredError)
@@ -369,27 +518,98 @@ func (fp *FeatureProbe) JsonDetail(toggle string, user FPUser, defaultValue inte
 		}
 	}()
 
-	value, ruleIndex, version, reason := fp.genericDetail(toggle, user, defaultValue)
-	result = FPJsonDetail{Value: value, RuleIndex: ruleIndex, Version: version, Reason: reason}
+	detail := fp.genericDetail(toggle, user, defaultValue, opts...)
+	result = FPJsonDetail{Value: detail.Value, RuleIndex: detail.RuleIndex, Version: detail.Version, Reason: detail.Reason,
+		SegmentMembershipStale: detail.SegmentMembershipStale, ExperimentId: detail.ExperimentId,
+		InExperiment: detail.InExperiment, Holdout: detail.Holdout, Layer: detail.Layer}
 	return
 }
 
 func newHttpClient(timeout time.Duration) http.Client {
 	return http.Client{
-		Timeout: timeout * time.Millisecond,
-		Transport: &http.Transport{
-			Proxy: http.ProxyFromEnvironment,
-			DialContext: (&net.Dialer{
-				Timeout:   10 * time.Second,
-				KeepAlive: 10 * time.Second,
-			}).DialContext,
-			ForceAttemptHTTP2:     true,
-			MaxIdleConns:          10,
-			IdleConnTimeout:       90 * time.Second,
-			TLSHandshakeTimeout:   2 * time.Second,
-			ExpectContinueTimeout: 1 * time.Second,
-		},
+		Timeout:   timeout * time.Millisecond,
+		Transport: newHttpTransport(),
+	}
+}
+
+func newHttpTransport() *http.Transport {
+	return &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   10 * time.Second,
+			KeepAlive: 10 * time.Second,
+		}).DialContext,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          10,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   2 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+}
+
+// newHttpClient builds the http client shared by Synchronizer and EventRecorder
+// from the transport settings of the config.
+// realtimeEnabled reports whether to connect the realtime socket, which
+// can't go through a custom transport.
+func (config *FPConfig) realtimeEnabled() bool {
+	if config.DisableRealtime || config.DaemonMode {
+		return false
+	}
+	if config.HttpClient != nil || config.Transport != nil || config.TLSConfig != nil || config.Proxy != nil {
+		fmt.Printf("FP realtime updates are off, the realtime socket can't use a custom http transport\n")
+		return false
+	}
+	return true
+}
+
+func (config *FPConfig) newHttpClient(timeout time.Duration) http.Client {
+	if config.HttpClient != nil {
+		return *config.HttpClient
+	}
+	client := newHttpClient(timeout)
+	if config.Transport != nil {
+		client.Transport = config.Transport
+		return client
+	}
+	transport := newHttpTransport()
+	if config.TLSConfig != nil {
+		transport.TLSClientConfig = config.TLSConfig
+	}
+	if config.Proxy != nil {
+		transport.Proxy = config.Proxy
+	}
+	client.Transport = transport
+	return client
+}
+
+func (config *FPConfig) userAgent() string {
+	if len(config.WrapperName) == 0 {
+		return USER_AGENT
+	}
+	wrapper := config.WrapperName
+	if len(config.WrapperVersion) != 0 {
+		wrapper += "/" + config.WrapperVersion
+	}
+	return USER_AGENT + " " + wrapper
+}
+
+func setRequestHeaders(req *http.Request, headers http.Header, auth string, userAgent string) {
+	for key, values := range headers {
+		for _, value := range values {
+			req.Header.Add(key, value)
+		}
+	}
+	req.Header.Set("Authorization", auth)
+	req.Header.Set("User-Agent", userAgent)
+}
+
+// ValidationReport returns the problems found in the toggles and segments
+// last loaded from the server or the custom repository.
+func (fp *FeatureProbe) ValidationReport() ValidationReport {
+	if fp.Repo == nil {
+		return ValidationReport{}
 	}
+	return fp.Repo.validationReport()
 }
 
 // Initialized return false means not successfully fetch remote resource
@@ -413,7 +633,8 @@ func (fp *FeatureProbe) Close() {
 	if fp.Syncer != nil {
 		fp.Syncer.Stop()
 	}
-	if fp.Repo != nil {
+	// stores supplied by the caller may be shared with other instances
+	if fp.Repo != nil && fp.Config.Repo == nil && fp.Config.ToggleStore == nil && fp.Config.DataStore == nil {
 		fp.Repo.Clear()
 	}
 	if fp.Recorder != nil {
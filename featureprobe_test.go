@@ -1,12 +1,18 @@
 package featureprobe
 
 import (
+	"crypto/tls"
 	"encoding/json"
 	"io/ioutil"
+	"net/http"
+	"net/url"
+	"reflect"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/jarcoal/httpmock"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -25,6 +31,122 @@ func TestNewFeatureProbe(t *testing.T) {
 	assert.True(t, client.Initialized())
 }
 
+func TestCustomTransport(t *testing.T) {
+	_, jsonStr := setup(t)
+	transport := httpmock.NewMockTransport()
+	transport.RegisterResponder("GET", "https://featureprobe.com/api/server-sdk/toggles",
+		httpmock.NewStringResponder(200, jsonStr))
+	transport.RegisterResponder("POST", "https://featureprobe.com/api/events",
+		httpmock.NewStringResponder(200, "{}"))
+
+	config := FPConfig{
+		RemoteUrl:       "https://featureprobe.com/",
+		RefreshInterval: 100 * time.Millisecond,
+		StartWait:       2 * time.Second,
+		Transport:       transport,
+	}
+	fp := NewFeatureProbe(config)
+	defer fp.Close()
+
+	assert.True(t, fp.Initialized())
+	assert.True(t, transport.GetTotalCallCount() > 0)
+	assert.Equal(t, transport, fp.Syncer.httpClient.Transport)
+	assert.Equal(t, transport, fp.Recorder.httpClient.Transport)
+}
+
+func TestCustomHttpClient(t *testing.T) {
+	client := &http.Client{Timeout: 3 * time.Second}
+	config := FPConfig{
+		RemoteUrl:       "https://featureprobe.com/",
+		RefreshInterval: 100 * time.Millisecond,
+		HttpClient:      client,
+	}
+	fp := NewFeatureProbe(config)
+	defer fp.Close()
+
+	assert.Equal(t, client.Timeout, fp.Syncer.httpClient.Timeout)
+	assert.Equal(t, client.Timeout, fp.Recorder.httpClient.Timeout)
+}
+
+func TestCustomTLSConfigAndProxy(t *testing.T) {
+	tlsConfig := &tls.Config{ServerName: "featureprobe.internal"}
+	proxyUrl, _ := url.Parse("http://proxy.internal:3128")
+	config := FPConfig{
+		RemoteUrl:       "https://featureprobe.com/",
+		RefreshInterval: 100 * time.Millisecond,
+		TLSConfig:       tlsConfig,
+		Proxy:           http.ProxyURL(proxyUrl),
+	}
+	client := config.newHttpClient(config.RefreshInterval)
+	transport, ok := client.Transport.(*http.Transport)
+	assert.True(t, ok)
+	assert.Equal(t, tlsConfig, transport.TLSClientConfig)
+
+	req, _ := http.NewRequest(http.MethodGet, "https://featureprobe.com/", nil)
+	proxy, err := transport.Proxy(req)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, proxyUrl, proxy)
+}
+
+func TestCustomHeaders(t *testing.T) {
+	_, jsonStr := setup(t)
+	var header http.Header
+	var mu sync.Mutex
+	transport := httpmock.NewMockTransport()
+	transport.RegisterResponder("GET", "https://featureprobe.com/api/server-sdk/toggles",
+		func(req *http.Request) (*http.Response, error) {
+			mu.Lock()
+			header = req.Header.Clone()
+			mu.Unlock()
+			return httpmock.NewStringResponse(200, jsonStr), nil
+		})
+
+	config := FPConfig{
+		RemoteUrl:       "https://featureprobe.com/",
+		ServerSdkKey:    "sdk_key",
+		RefreshInterval: 100 * time.Millisecond,
+		StartWait:       2 * time.Second,
+		Transport:       transport,
+		Headers:         http.Header{"X-Tenant-Id": []string{"tenant"}},
+		WrapperName:     "wrapper",
+		WrapperVersion:  "1.0",
+	}
+	fp := NewFeatureProbe(config)
+	defer fp.Close()
+
+	assert.True(t, fp.Initialized())
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, "tenant", header.Get("X-Tenant-Id"))
+	assert.Equal(t, "sdk_key", header.Get("Authorization"))
+	assert.Equal(t, USER_AGENT+" wrapper/1.0", header.Get("User-Agent"))
+}
+
+func TestMultipleClientsIsolation(t *testing.T) {
+	clients := []*FeatureProbe{
+		NewFeatureProbeForTest(map[string]interface{}{"toggle": "tenant_a"}),
+		NewFeatureProbeForTest(map[string]interface{}{"toggle": "tenant_b"}),
+	}
+	clients[0].Config.WrapperName = "wrapper_a"
+	expects := []string{"tenant_a", "tenant_b"}
+
+	var wg sync.WaitGroup
+	for i := range clients {
+		for j := 0; j < 10; j++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				user := NewUser().StableRollout("key")
+				assert.Equal(t, expects[i], clients[i].StrValue("toggle", user, ""))
+			}(i)
+		}
+	}
+	wg.Wait()
+
+	assert.Equal(t, USER_AGENT+" wrapper_a", clients[0].Config.userAgent())
+	assert.Equal(t, USER_AGENT, clients[1].Config.userAgent())
+}
+
 func TestEvalNilRepo(t *testing.T) {
 	config := FPConfig{
 		RemoteUrl: "https://featureprobe.com/",
@@ -67,7 +189,7 @@ func TestEval(t *testing.T) {
 
 	user := NewUser().StableRollout("key11").With("city", "4")
 
-	fp := setupFeatureProbe(t, repo)
+	fp := setupFeatureProbe(t, &repo)
 
 	val := fp.BoolValue("bool_toggle", user, true)
 	assert.Equal(t, false, val)
@@ -97,7 +219,7 @@ func TestEvalTypeMismatch(t *testing.T) {
 	assert.Equal(t, nil, err)
 
 	user := NewUser().StableRollout("key11").With("city", "4")
-	fp := setupFeatureProbe(t, repo)
+	fp := setupFeatureProbe(t, &repo)
 
 	val := fp.BoolValue("number_toggle", user, true)
 	assert.Equal(t, true, val)
@@ -122,7 +244,7 @@ func TestEvalNotExist(t *testing.T) {
 	assert.Equal(t, nil, err)
 
 	user := NewUser().With("city", "4")
-	fp := setupFeatureProbe(t, repo)
+	fp := setupFeatureProbe(t, &repo)
 
 	val := fp.BoolValue("not_exist_toggle", user, true)
 	assert.Equal(t, true, val)
@@ -210,7 +332,7 @@ func TestOutOfIndexToggle(t *testing.T) {
 	repo.flush(repoData)
 	assert.Equal(t, nil, err)
 
-	fp := setupFeatureProbe(t, repo)
+	fp := setupFeatureProbe(t, &repo)
 
 	user := NewUser().With("city", "4")
 
@@ -277,6 +399,39 @@ func TestCloseClient(t *testing.T) {
 	assert.Equal(t, 0, len(fp.Repo.getToggles()))
 }
 
+func TestDisableRealtime(t *testing.T) {
+	fp := NewFeatureProbe(FPConfig{RemoteUrl: "http://localhost/", RefreshInterval: 100 * time.Millisecond})
+	assert.NotNil(t, fp.Socket)
+	fp.Close()
+
+	fp = NewFeatureProbe(FPConfig{RemoteUrl: "http://localhost/", RefreshInterval: 100 * time.Millisecond,
+		DisableRealtime: true})
+	assert.Nil(t, fp.Socket)
+	fp.Close()
+	for _, config := range []FPConfig{
+		{HttpClient: &http.Client{}},
+		{Transport: &http.Transport{}},
+		{TLSConfig: &tls.Config{}},
+		{Proxy: http.ProxyFromEnvironment},
+	} {
+		config.RemoteUrl = "http://localhost/"
+		config.RefreshInterval = 100 * time.Millisecond
+		fp = NewFeatureProbe(config)
+		assert.Nil(t, fp.Socket)
+		fp.Close()
+	}
+}
+
+func TestCloseKeepsCallerRepo(t *testing.T) {
+	repo, _ := loadRepoFromFile()
+	toggles := len(repo.getToggles())
+	assert.True(t, toggles > 0)
+
+	fp := NewFeatureProbe(FPConfig{RefreshInterval: 100 * time.Millisecond, Repo: repo})
+	fp.Close()
+	assert.Equal(t, toggles, len(repo.getToggles()))
+}
+
 func TestTrack(t *testing.T) {
 	config := FPConfig{
 		RemoteUrl: "http://localhost/",
@@ -291,6 +446,163 @@ func TestTrack(t *testing.T) {
 	fp.Close()
 }
 
+func TestTrackContexts(t *testing.T) {
+	config := FPConfig{
+		RemoteUrl:       "http://localhost/",
+		RefreshInterval: 100 * time.Millisecond,
+	}
+	fp := NewFeatureProbe(config)
+	user := NewUser().StableRollout("user1").
+		WithContext("organization", NewUser().StableRollout("org1")).
+		WithContext("device", NewUser().StableRollout("device1"))
+	fp.Track("some_event", user, nil)
+	event := (fp.Recorder.incomingEvents[0]).(CustomEvent)
+	assert.Equal(t, "user1", event.User)
+	assert.Equal(t, map[string]string{"organization": "org1", "device": "device1"}, event.Contexts)
+	fp.Close()
+}
+
+func TestExperimentAccessEvents(t *testing.T) {
+	repo := Repository{}
+	repo.flush(RepositoryData{Toggles: map[string]Toggle{
+		"checkout": setupExperimentToggle("checkout", nil),
+	}})
+	fp := setupFeatureProbe(t, &repo)
+
+	detail := fp.StrDetail("checkout", NewUser().StableRollout("user"), "default")
+	assert.Equal(t, "exp_checkout", detail.ExperimentId)
+	assert.True(t, detail.InExperiment)
+	assert.Equal(t, 1, len(fp.Recorder.incomingEvents))
+	event := fp.Recorder.incomingEvents[0].(AccessEvent)
+	assert.Equal(t, "exp_checkout", event.ExperimentId)
+	assert.True(t, event.InExperiment)
+}
+
+func TestExplainSplit(t *testing.T) {
+	zero := 0
+	checkout := setupExperimentToggle("checkout", nil)
+	checkout.DefaultServe.Split.BucketBy = "device"
+	checkout.DefaultServe.Split.Salt = "checkout_salt"
+	checkout.Rules = []Rule{{
+		Serve: checkout.DefaultServe,
+		Conditions: []Condition{
+			{Type: "string", Subject: "city", Predicate: "is one of", Objects: []string{"Paris"}},
+		},
+	}}
+	layered := setupLayerToggle("layered", Range{Lower: 0, Upper: 10000})
+	held := setupExperimentToggle("held", &Holdout{Key: "q4_holdout", Ranges: []Range{{Lower: 0, Upper: 10000}},
+		Variation: 2})
+	repo := Repository{}
+	repo.flush(RepositoryData{Toggles: map[string]Toggle{
+		"checkout": checkout,
+		"layered":  layered,
+		"held":     held,
+		"selected": {Key: "selected", Enabled: true, DefaultServe: Serve{Select: &zero},
+			Variations: []interface{}{true}},
+	}})
+	fp := &FeatureProbe{Repo: &repo, Config: FPConfig{MaxPrerequisitesDeep: 5}}
+	user := NewUser().StableRollout("user").With("device", "device1")
+
+	explanation, ok := fp.ExplainSplit("checkout", user)
+	assert.True(t, ok)
+	assert.Nil(t, explanation.RuleIndex)
+	assert.Equal(t, "device1", explanation.HashKey)
+	assert.Equal(t, "device", explanation.BucketBy)
+	assert.Equal(t, "checkout_salt", explanation.Salt)
+	assert.Equal(t, Bucket("device1", "checkout_salt"), explanation.BucketIndex)
+	assert.True(t, explanation.Range.Lower <= explanation.BucketIndex && explanation.BucketIndex < explanation.Range.Upper)
+	variations := checkout.DefaultServe.Split.Distribution[explanation.VariationIndex]
+	assert.Contains(t, variations, explanation.Range)
+	assert.Equal(t, fp.StrValue("checkout", user, ""), checkout.Variations[explanation.VariationIndex])
+
+	explanation, _ = fp.ExplainSplit("checkout", user.With("city", "Paris"))
+	assert.Equal(t, 0, *explanation.RuleIndex)
+
+	explanation, ok = fp.ExplainSplit("layered", user)
+	assert.True(t, ok)
+	assert.Equal(t, "checkout_layer", explanation.Layer)
+	assert.Equal(t, "layered", explanation.Salt)
+
+	explanation, ok = fp.ExplainSplit("held", user)
+	assert.True(t, ok)
+	assert.Equal(t, "q4_holdout", explanation.Holdout)
+	assert.Equal(t, "q4_holdout", explanation.Salt)
+	assert.Equal(t, Bucket("user", "q4_holdout"), explanation.BucketIndex)
+	assert.Equal(t, 2, explanation.VariationIndex)
+
+	_, ok = fp.ExplainSplit("selected", user)
+	assert.False(t, ok)
+	_, ok = fp.ExplainSplit("not_exist", user)
+	assert.False(t, ok)
+}
+
+func TestZeroValueUserEvaluation(t *testing.T) {
+	repo := Repository{}
+	repo.flush(RepositoryData{Toggles: map[string]Toggle{
+		"checkout": setupExperimentToggle("checkout", nil),
+	}})
+	fp := setupFeatureProbe(t, &repo)
+
+	detail := fp.StrDetail("checkout", FPUser{}, "default")
+	assert.NotEqual(t, "default", detail.Value)
+	assert.True(t, detail.InExperiment)
+	event := fp.Recorder.incomingEvents[0].(AccessEvent)
+	assert.Equal(t, 36, len(event.User))
+	assert.True(t, event.Anonymous)
+
+	_, ok := fp.ExplainSplit("checkout", FPUser{})
+	assert.True(t, ok)
+}
+
+func TestZeroValueUserEvents(t *testing.T) {
+	var repo Repository
+	bytes, _ := ioutil.ReadFile("./resources/fixtures/repo.json")
+	repoData := RepositoryData{}
+	json.Unmarshal(bytes, &repoData)
+	repoData.DebugUntilTime = uint64((time.Now().UnixNano() / 1e6) + 5000)
+	repo.flush(repoData)
+	fp := setupFeatureProbe(t, &repo)
+
+	// only users created by NewUser keep their random key between calls
+	fp.BoolValue("bool_toggle", FPUser{}, true)
+	fp.Track("some_event", FPUser{}, nil)
+	user := NewUser()
+	fp.BoolValue("bool_toggle", user, true)
+	fp.Track("some_event", user, nil)
+
+	zeroDebug := (fp.Recorder.incomingEvents[0]).(DebugEvent)
+	zeroCustom := (fp.Recorder.incomingEvents[1]).(CustomEvent)
+	assert.NotEqual(t, zeroDebug.User, zeroCustom.User)
+	debugEvent := (fp.Recorder.incomingEvents[2]).(DebugEvent)
+	customEvent := (fp.Recorder.incomingEvents[3]).(CustomEvent)
+	assert.Equal(t, debugEvent.User, customEvent.User)
+}
+
+func TestAnonymousUserEvents(t *testing.T) {
+	var repo Repository
+	bytes, _ := ioutil.ReadFile("./resources/fixtures/repo.json")
+	repoData := RepositoryData{}
+	json.Unmarshal(bytes, &repoData)
+	repoData.DebugUntilTime = uint64((time.Now().UnixNano() / 1e6) + 5000)
+	repo.flush(repoData)
+
+	user := NewUser().With("city", "4")
+	fp := setupFeatureProbe(t, &repo)
+	fp.BoolValue("bool_toggle", user, true)
+	fp.Track("some_event", user, nil)
+	fp.BoolValue("bool_toggle", user.StableRollout("user1"), true)
+
+	debugEvent := (fp.Recorder.incomingEvents[0]).(DebugEvent)
+	assert.True(t, debugEvent.Anonymous)
+	assert.Equal(t, user.Key(), debugEvent.User)
+	customEvent := (fp.Recorder.incomingEvents[1]).(CustomEvent)
+	assert.True(t, customEvent.Anonymous)
+	assert.Equal(t, user.Key(), customEvent.User)
+	debugEvent = (fp.Recorder.incomingEvents[2]).(DebugEvent)
+	assert.False(t, debugEvent.Anonymous)
+	assert.Equal(t, "user1", debugEvent.User)
+}
+
 func TestRecorderDebugEvent(t *testing.T) {
 	var repo Repository
 	bytes, _ := ioutil.ReadFile("./resources/fixtures/repo.json")
@@ -300,7 +612,7 @@ func TestRecorderDebugEvent(t *testing.T) {
 	repo.flush(repoData)
 
 	user := NewUser().With("city", "4")
-	fp := setupFeatureProbe(t, repo)
+	fp := setupFeatureProbe(t, &repo)
 	fp.BoolValue("bool_toggle", user, true)
 
 	assert.Equal(t, 1, len(fp.Recorder.incomingEvents))
@@ -312,18 +624,45 @@ func TestRecorderDebugEvent(t *testing.T) {
 	assert.Equal(t, debugEvent.Reason, "rule 1 ")
 }
 
+func TestRecorderDebugEventRedacted(t *testing.T) {
+	var repo Repository
+	bytes, _ := ioutil.ReadFile("./resources/fixtures/repo.json")
+	repoData := RepositoryData{}
+	json.Unmarshal(bytes, &repoData)
+	repoData.DebugUntilTime = uint64((time.Now().UnixNano() / 1e6) + 5000)
+	repo.flush(repoData)
+
+	user := NewUser().With("city", "4").With("email", "a@b.c").WithPrivate("phone", "555")
+	fp := setupFeatureProbe(t, &repo)
+	fp.Config.PrivateAttributes = []string{"email"}
+	fp.BoolValue("bool_toggle", user, true)
+
+	debugEvent := (fp.Recorder.incomingEvents[0]).(DebugEvent)
+	assert.Equal(t, *debugEvent.RuleIndex, 1)
+	assert.Equal(t, []string{"email", "phone"}, debugEvent.RedactedAttributes)
+	assert.Equal(t, map[string]string{"city": "4"}, debugEvent.UserDetail["attrs"])
+}
+
 func TestNotRecorderDebugEvent(t *testing.T) {
 	var repo Repository
 	bytes, _ := ioutil.ReadFile("./resources/fixtures/repo.json")
 	json.Unmarshal(bytes, &repo)
 	user := NewUser().With("city", "4")
-	fp := setupFeatureProbe(t, repo)
+	fp := setupFeatureProbe(t, &repo)
 	fp.BoolValue("bool_toggle", user, true)
 	assert.Equal(t, 0, len(fp.Recorder.incomingEvents))
 }
 
 func TestContract(t *testing.T) {
-	bytes, _ := ioutil.ReadFile("./resources/fixtures/server-sdk-specification/spec/toggle_simple_spec.json")
+	runContractTests(t, "./resources/fixtures/server-sdk-specification/spec/toggle_simple_spec.json")
+}
+
+func TestConditionContract(t *testing.T) {
+	runContractTests(t, "./resources/fixtures/condition_spec.json")
+}
+
+func runContractTests(t *testing.T, path string) {
+	bytes, _ := ioutil.ReadFile(path)
 	var tests ContractTests
 	err := json.Unmarshal(bytes, &tests)
 	assert.Equal(t, nil, err)
@@ -341,7 +680,9 @@ func TestContract(t *testing.T) {
 			t.Log("  case: ", Case.Name)
 			user := NewUser().StableRollout(Case.User.Key)
 			for _, kv := range Case.User.CustomValues {
-				user = user.With(kv.Key, kv.Value)
+				value, err := attrValue(reflect.ValueOf(kv.Value))
+				assert.Nil(t, err)
+				user = user.with(kv.Key, value, false)
 			}
 
 			switch Case.Function.Name {
@@ -449,15 +790,14 @@ func assertJsonDetail(t *testing.T, Case Case, r FPJsonDetail) {
 	}
 }
 
-func setupFeatureProbe(t *testing.T, repo Repository) *FeatureProbe {
+func setupFeatureProbe(t *testing.T, repo *Repository) *FeatureProbe {
 	config := FPConfig{
 		RemoteUrl: "https://featureprobe.com/",
 		RefreshInterval: 1 * time.Second,
-		Repo:            &repo,
+		Repo:            repo,
 	}
 
-	fp := NewFeatureProbe(config)
-	return &fp
+	return NewFeatureProbe(config)
 }
 
 type ContractTests struct {
@@ -497,6 +837,210 @@ type ExpectResult struct {
 }
 
 type KeyValue struct {
-	Key   string `json:"key"`
-	Value string `json:"value"`
+	Key   string      `json:"key"`
+	Value interface{} `json:"value"`
+}
+
+// memoryDataStore is a DataStore counting its reads.
+type memoryDataStore struct {
+	mu             sync.Mutex
+	memory         MemoryStore
+	debugUntilTime uint64
+	version        uint64
+	reads          int
+}
+
+func (s *memoryDataStore) Init(data RepositoryData) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.memory.Apply(data)
+	s.debugUntilTime = data.DebugUntilTime
+	s.version++
+	return nil
+}
+
+func (s *memoryDataStore) GetToggle(key string) (Toggle, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.reads++
+	toggle, ok := s.memory.Get(key)
+	return toggle, ok, nil
+}
+
+func (s *memoryDataStore) GetToggles() (map[string]Toggle, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.reads++
+	return s.memory.All(), nil
+}
+
+func (s *memoryDataStore) GetSegments() (map[string]Segment, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.reads++
+	return s.memory.Segments(), nil
+}
+
+func (s *memoryDataStore) GetDebugUntilTime() (uint64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.debugUntilTime, nil
+}
+
+func (s *memoryDataStore) Upsert(toggle Toggle) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.memory.Upsert(toggle)
+	s.version++
+	return nil
+}
+
+func (s *memoryDataStore) Delete(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.memory.Delete(key)
+	s.version++
+	return nil
+}
+
+func (s *memoryDataStore) Version() (uint64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.version, nil
+}
+
+func (s *memoryDataStore) readCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.reads
+}
+
+func loadRepoDataFromFile(t *testing.T) RepositoryData {
+	bytes, _ := ioutil.ReadFile("./resources/fixtures/repo.json")
+	repoData := RepositoryData{}
+	assert.Nil(t, json.Unmarshal(bytes, &repoData))
+	return repoData
+}
+
+func TestDataStoreSnapshot(t *testing.T) {
+	store := &memoryDataStore{}
+	repoData := loadRepoDataFromFile(t)
+	repoData.DebugUntilTime = 1600000000000
+	_ = store.Init(repoData)
+
+	config := FPConfig{DataStore: store}
+	repo := config.newRepository()
+	assert.Equal(t, len(repoData.Toggles), len(repo.getToggles()))
+	assert.Equal(t, repoData.DebugUntilTime, repo.getDebugUntilTime())
+	toggle, _ := repo.getToggle("bool_toggle")
+	assert.True(t, toggle.compiled)
+	storeVersion, _ := store.Version()
+	assert.Equal(t, uint64(1), storeVersion)
+
+	repoData.DebugUntilTime = 1700000000000
+	repo.flush(repoData)
+	debugUntilTime, _ := store.GetDebugUntilTime()
+	assert.Equal(t, repoData.DebugUntilTime, debugUntilTime)
+	version := repo.Store().Version()
+
+	reads := store.readCount()
+	fp := FeatureProbe{Repo: repo, Config: FPConfig{MaxPrerequisitesDeep: 5}}
+	fp.BoolValue("bool_toggle", NewUser().StableRollout("key"), false)
+	fp.StrValue("string_toggle", NewUser().StableRollout("key"), "")
+	assert.Equal(t, reads, store.readCount())
+
+	toggle, _ = repo.getToggle("bool_toggle")
+	toggle.Version++
+	repo.Store().Upsert(toggle)
+	stored, _, _ := store.GetToggle("bool_toggle")
+	assert.Equal(t, toggle.Version, stored.Version)
+	assert.True(t, repo.Store().Version() > version)
+}
+
+func TestDaemonModeDataStore(t *testing.T) {
+	store := &memoryDataStore{}
+	repoData := loadRepoDataFromFile(t)
+	repoData.DebugUntilTime = 1700000000000
+	_ = store.Init(repoData)
+
+	fp := NewFeatureProbe(FPConfig{
+		RemoteUrl:       "http://localhost/",
+		RefreshInterval: time.Minute,
+		DataStore:       store,
+		DaemonMode:      true,
+	})
+	defer fp.Close()
+
+	assert.True(t, fp.Initialized())
+	assert.Nil(t, fp.Socket)
+	assert.Equal(t, repoData.DebugUntilTime, fp.Repo.getDebugUntilTime())
+	toggle, ok := fp.Repo.getToggle("bool_toggle")
+	assert.True(t, ok)
+	assert.True(t, toggle.compiled)
+
+	reads := store.readCount()
+	version := fp.Repo.Store().Version()
+	fp.BoolValue("bool_toggle", NewUser().StableRollout("key"), false)
+	assert.Nil(t, fp.Syncer.FetchDataStore())
+	assert.Equal(t, reads, store.readCount())
+	assert.Equal(t, version, fp.Repo.Store().Version())
+
+	toggle.Version++
+	toggle.Enabled = false
+	_ = store.Upsert(toggle)
+	assert.Nil(t, fp.Syncer.FetchDataStore())
+	toggle, _ = fp.Repo.getToggle("bool_toggle")
+	assert.False(t, toggle.Enabled)
+	assert.True(t, toggle.compiled)
+	assert.True(t, fp.Repo.Store().Version() > version)
+}
+
+func TestDaemonModeWithoutDataStore(t *testing.T) {
+	fp := NewFeatureProbe(FPConfig{
+		RemoteUrl:       "http://localhost/",
+		RefreshInterval: 100 * time.Millisecond,
+		StartWait:       300 * time.Millisecond,
+		DaemonMode:      true,
+	})
+	defer fp.Close()
+
+	assert.False(t, fp.Initialized())
+	assert.Nil(t, fp.Socket)
+	assert.Nil(t, fp.Syncer.ticker)
+}
+
+func TestRelayUnchangedDataStore(t *testing.T) {
+	store := &memoryDataStore{}
+	relay := (&FPConfig{DataStore: store}).newRepository()
+	repoData := loadRepoDataFromFile(t)
+	relay.flush(repoData)
+
+	fp := NewFeatureProbe(FPConfig{
+		RemoteUrl:       "http://localhost/",
+		RefreshInterval: time.Minute,
+		DataStore:       store,
+		DaemonMode:      true,
+	})
+	defer fp.Close()
+	storeVersion, _ := store.Version()
+	version := fp.Repo.Store().Version()
+
+	for i := 0; i < 10; i++ {
+		relay.flush(loadRepoDataFromFile(t))
+		assert.Nil(t, fp.Syncer.FetchDataStore())
+	}
+	unchanged, _ := store.Version()
+	assert.Equal(t, storeVersion, unchanged)
+	assert.Equal(t, version, fp.Repo.Store().Version())
+
+	repoData = loadRepoDataFromFile(t)
+	toggle := repoData.Toggles["bool_toggle"]
+	toggle.Version++
+	toggle.Enabled = false
+	repoData.Toggles["bool_toggle"] = toggle
+	relay.flush(repoData)
+	assert.Nil(t, fp.Syncer.FetchDataStore())
+	assert.True(t, fp.Repo.Store().Version() > version)
+	toggle, _ = fp.Repo.getToggle("bool_toggle")
+	assert.False(t, toggle.Enabled)
 }
@@ -1,14 +1,19 @@
 module github.com/featureprobe/server-sdk-go/v2
 
-go 1.13
+go 1.21
 
 require (
-	github.com/Masterminds/semver v1.5.0 // indirect
+	// Constraints.IncludePrerelease, used by the "include" prerelease policy,
+	// needs semver v3.3.0 or later, which requires go 1.21.
+	github.com/Masterminds/semver/v3 v3.4.0
+	github.com/alicebob/miniredis/v2 v2.30.0
+	github.com/google/uuid v1.3.0
 	github.com/jarcoal/httpmock v1.3.0
 	github.com/kr/pretty v0.3.1 // indirect
-	github.com/masterminds/semver v1.5.0
 	github.com/maxatome/go-testdeep v1.13.0 // indirect
+	github.com/redis/go-redis/v9 v9.0.5
 	github.com/socket-iox/socket-io-client-go v1.0.4
 	github.com/stretchr/testify v1.8.2
+	golang.org/x/text v0.14.0
 	gopkg.in/check.v1 v1.0.0-20201130134442-10cb98267c6c // indirect
 )
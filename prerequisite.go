@@ -0,0 +1,271 @@
+package featureprobe
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// ErrPrerequisiteCycle is reported instead of evaluating toggles whose
+// prerequisites lead to a cycle. It wraps ErrPrerequisiteDeepOverflow since a
+// cycle is a prerequisite chain of infinite depth.
+var ErrPrerequisiteCycle = fmt.Errorf("%w caused by prerequisite cycle", ErrPrerequisiteDeepOverflow)
+
+// PrerequisiteGraph is the prerequisite dependency graph around a toggle.
+type PrerequisiteGraph struct {
+	Key string
+	// Prerequisites maps Key and every toggle it depends on, directly or
+	// transitively, to their direct prerequisites.
+	Prerequisites map[string][]string
+	// Dependents lists the toggles depending on Key directly or transitively,
+	// they are the ones affected by a change of Key.
+	Dependents []string
+	// Cycles lists the prerequisite cycles reachable from Key.
+	Cycles [][]string
+}
+
+// PrerequisiteGraph returns the prerequisite dependency graph of toggleKey,
+// ok is false if the toggle does not exist.
+func (fp *FeatureProbe) PrerequisiteGraph(toggleKey string) (graph PrerequisiteGraph, ok bool) {
+	if fp.Repo == nil {
+		return PrerequisiteGraph{}, false
+	}
+	toggles := fp.Repo.getToggles()
+	if _, ok := toggles[toggleKey]; !ok {
+		return PrerequisiteGraph{}, false
+	}
+	return buildPrerequisiteGraph(toggleKey, toggles), true
+}
+
+func buildPrerequisiteGraph(key string, toggles map[string]Toggle) PrerequisiteGraph {
+	graph := PrerequisiteGraph{Key: key, Prerequisites: map[string][]string{}}
+
+	queue := []string{key}
+	for len(queue) > 0 {
+		current := queue[0]
+		queue = queue[1:]
+		if _, visited := graph.Prerequisites[current]; visited {
+			continue
+		}
+		prerequisites := []string{}
+		for _, p := range toggles[current].Prerequisites {
+			prerequisites = append(prerequisites, p.Key)
+			if _, ok := toggles[p.Key]; ok {
+				queue = append(queue, p.Key)
+			}
+		}
+		graph.Prerequisites[current] = prerequisites
+	}
+
+	dependents := map[string][]string{}
+	for k, toggle := range toggles {
+		for _, p := range toggle.Prerequisites {
+			dependents[p.Key] = append(dependents[p.Key], k)
+		}
+	}
+	seen := map[string]bool{key: true}
+	queue = []string{key}
+	for len(queue) > 0 {
+		current := queue[0]
+		queue = queue[1:]
+		for _, d := range dependents[current] {
+			if !seen[d] {
+				seen[d] = true
+				graph.Dependents = append(graph.Dependents, d)
+				queue = append(queue, d)
+			}
+		}
+	}
+	sort.Strings(graph.Dependents)
+
+	for _, cycle := range findPrerequisiteCycles(toggles) {
+		if _, ok := graph.Prerequisites[cycle[0]]; ok {
+			graph.Cycles = append(graph.Cycles, cycle)
+		}
+	}
+	return graph
+}
+
+// findPrerequisiteCycles returns the prerequisite cycles of toggles, each one
+// starts and ends with the same toggle key.
+func findPrerequisiteCycles(toggles map[string]Toggle) [][]string {
+	keys := make([]string, 0, len(toggles))
+	for key := range toggles {
+		keys = append(keys, key)
+	}
+	return findCycles(keys, func(key string) []string {
+		var edges []string
+		for _, p := range toggles[key].Prerequisites {
+			if _, ok := toggles[p.Key]; ok {
+				edges = append(edges, p.Key)
+			}
+		}
+		return edges
+	})
+}
+
+// findCycles returns the cycles of the graph of keys, whose edges are given by
+// edges, each one starts and ends with the same key.
+func findCycles(keys []string, edges func(key string) []string) [][]string {
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := make(map[string]int, len(keys))
+	var path []string
+	var cycles [][]string
+
+	var visit func(key string)
+	visit = func(key string) {
+		state[key] = visiting
+		path = append(path, key)
+		for _, next := range edges(key) {
+			switch state[next] {
+			case visiting:
+				for i := len(path) - 1; i >= 0; i-- {
+					if path[i] == next {
+						cycle := append(append([]string{}, path[i:]...), next)
+						cycles = append(cycles, cycle)
+						break
+					}
+				}
+			case unvisited:
+				visit(next)
+			}
+		}
+		path = path[:len(path)-1]
+		state[key] = visited
+	}
+
+	sort.Strings(keys)
+	for _, key := range keys {
+		if state[key] == unvisited {
+			visit(key)
+		}
+	}
+	return cycles
+}
+
+// reachPrerequisiteCycle returns the keys of the toggles whose prerequisites
+// lead to one of cycles, the toggles in the cycles included.
+func reachPrerequisiteCycle(toggles map[string]Toggle, cycles [][]string) map[string]bool {
+	reach := map[string]bool{}
+	for _, cycle := range cycles {
+		for _, key := range cycle {
+			reach[key] = true
+		}
+	}
+	done := map[string]bool{}
+	var visit func(key string) bool
+	visit = func(key string) bool {
+		if reach[key] || done[key] {
+			return reach[key]
+		}
+		done[key] = true
+		for _, p := range toggles[key].Prerequisites {
+			if visit(p.Key) {
+				reach[key] = true
+			}
+		}
+		return reach[key]
+	}
+	for key := range toggles {
+		visit(key)
+	}
+	return reach
+}
+
+// markPrerequisiteCycles flags the toggles of data whose evaluation would
+// run into a prerequisite cycle, data.Toggles must not be shared.
+func markPrerequisiteCycles(data RepositoryData) {
+	reach := reachPrerequisiteCycle(data.Toggles, findPrerequisiteCycles(data.Toggles))
+	for key, toggle := range data.Toggles {
+		if toggle.prerequisiteCycle != reach[key] {
+			toggle.prerequisiteCycle = reach[key]
+			data.Toggles[key] = toggle
+		}
+	}
+}
+
+func formatPrerequisiteCycle(cycle []string) string {
+	return strings.Join(cycle, " -> ")
+}
+
+// jsonValueEqual compares two values as JSON values: numbers are equal when
+// numerically equal whatever their Go type, other types never equal a value
+// of a different JSON type, objects and arrays are compared deeply.
+func jsonValueEqual(a, b interface{}) bool {
+	a, b = normalizeJsonValue(a), normalizeJsonValue(b)
+	switch av := a.(type) {
+	case nil:
+		return b == nil
+	case float64:
+		bv, ok := b.(float64)
+		return ok && av == bv
+	case string:
+		bv, ok := b.(string)
+		return ok && av == bv
+	case bool:
+		bv, ok := b.(bool)
+		return ok && av == bv
+	case []interface{}:
+		bv, ok := b.([]interface{})
+		if !ok || len(av) != len(bv) {
+			return false
+		}
+		for i := range av {
+			if !jsonValueEqual(av[i], bv[i]) {
+				return false
+			}
+		}
+		return true
+	case map[string]interface{}:
+		bv, ok := b.(map[string]interface{})
+		if !ok || len(av) != len(bv) {
+			return false
+		}
+		for key, value := range av {
+			other, ok := bv[key]
+			if !ok || !jsonValueEqual(value, other) {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// normalizeJsonValue converts v to the types produced by decoding JSON into an
+// interface{}, values which are not JSON encodable are returned unchanged.
+func normalizeJsonValue(v interface{}) interface{} {
+	switch value := v.(type) {
+	case nil, float64, string, bool, []interface{}, map[string]interface{}:
+		return v
+	case json.Number:
+		if f, err := value.Float64(); err == nil {
+			return f
+		}
+		return v
+	}
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(rv.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(rv.Uint())
+	case reflect.Float32, reflect.Float64:
+		return rv.Float()
+	}
+	bytes, err := json.Marshal(v)
+	if err != nil {
+		return v
+	}
+	var decoded interface{}
+	if err := json.Unmarshal(bytes, &decoded); err != nil {
+		return v
+	}
+	return decoded
+}
@@ -0,0 +1,173 @@
+package featureprobe
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newPrerequisiteToggle(key string, value interface{}, prerequisites ...string) Toggle {
+	toggle := newToggleForTest(key, value)
+	for _, p := range prerequisites {
+		toggle.Prerequisites = append(toggle.Prerequisites, Prerequisite{Key: p, Value: value})
+	}
+	return toggle
+}
+
+func newPrerequisiteRepo() *Repository {
+	repo := &Repository{}
+	repo.flush(RepositoryData{Toggles: map[string]Toggle{
+		"a": newPrerequisiteToggle("a", "1", "b"),
+		"b": newPrerequisiteToggle("b", "1", "c"),
+		"c": newPrerequisiteToggle("c", "1", "b"),
+		"d": newPrerequisiteToggle("d", "1", "e"),
+		"e": newPrerequisiteToggle("e", "1"),
+		"f": newPrerequisiteToggle("f", "1", "d", "e"),
+	}})
+	return repo
+}
+
+func TestFindPrerequisiteCycles(t *testing.T) {
+	repo := newPrerequisiteRepo()
+	cycles := findPrerequisiteCycles(repo.getToggles())
+	assert.Equal(t, [][]string{{"b", "c", "b"}}, cycles)
+
+	reach := reachPrerequisiteCycle(repo.getToggles(), cycles)
+	assert.Equal(t, map[string]bool{"a": true, "b": true, "c": true}, reach)
+}
+
+func TestPrerequisiteCycleEvaluation(t *testing.T) {
+	repo := newPrerequisiteRepo()
+	user := NewUser()
+
+	for _, key := range []string{"a", "b", "c"} {
+		toggle, _ := repo.getToggle(key)
+		assert.True(t, toggle.prerequisiteCycle)
+		_, err := toggle.doEvalDetail(user, repo.getToggles(), repo.getSegments(), nil, 20)
+		assert.True(t, errors.Is(err, ErrPrerequisiteCycle))
+		assert.True(t, errors.Is(err, ErrPrerequisiteDeepOverflow))
+
+		detail, err := toggle.evalDetail(user, repo.getToggles(), repo.getSegments(), nil, 20)
+		assert.Empty(t, err)
+		assert.Contains(t, detail.Reason, "prerequisite cycle")
+	}
+
+	toggle, _ := repo.getToggle("f")
+	assert.False(t, toggle.prerequisiteCycle)
+	detail, err := toggle.evalDetail(user, repo.getToggles(), repo.getSegments(), nil, 20)
+	assert.Empty(t, err)
+	assert.Equal(t, "default", detail.Reason)
+}
+
+func TestPrerequisiteCycleValidation(t *testing.T) {
+	repo := newPrerequisiteRepo()
+	report := repo.validationReport()
+	assert.Equal(t, "prerequisite cycle b -> c -> b", report.Toggles["b"][0].Message)
+	assert.Equal(t, "prerequisite cycle b -> c -> b", report.Toggles["c"][0].Message)
+	assert.NotContains(t, report.Toggles, "a")
+}
+
+func TestPrerequisiteGraph(t *testing.T) {
+	fp := FeatureProbe{Repo: newPrerequisiteRepo()}
+
+	graph, ok := fp.PrerequisiteGraph("e")
+	assert.True(t, ok)
+	assert.Equal(t, map[string][]string{"e": {}}, graph.Prerequisites)
+	assert.Equal(t, []string{"d", "f"}, graph.Dependents)
+	assert.Empty(t, graph.Cycles)
+
+	graph, _ = fp.PrerequisiteGraph("f")
+	assert.Equal(t, map[string][]string{"f": {"d", "e"}, "d": {"e"}, "e": {}}, graph.Prerequisites)
+	assert.Empty(t, graph.Dependents)
+
+	graph, _ = fp.PrerequisiteGraph("a")
+	assert.Equal(t, []string{"b", "c"}, []string{graph.Prerequisites["a"][0], graph.Prerequisites["b"][0]})
+	assert.Equal(t, [][]string{{"b", "c", "b"}}, graph.Cycles)
+
+	_, ok = fp.PrerequisiteGraph("not_exist")
+	assert.False(t, ok)
+}
+
+func TestJsonValueEqual(t *testing.T) {
+	cases := []struct {
+		a     interface{}
+		b     interface{}
+		equal bool
+	}{
+		{"1", "1", true},
+		{"1", 1.0, false},
+		{"true", true, false},
+		{true, true, true},
+		{true, false, false},
+		{1, 1.0, true},
+		{int64(2), float32(2), true},
+		{1.5, 1.0, false},
+		{nil, nil, true},
+		{nil, false, false},
+		{map[string]interface{}{"a": 1.0, "b": []interface{}{"x", true}},
+			map[string]interface{}{"b": []interface{}{"x", true}, "a": 1}, true},
+		{map[string]interface{}{"a": 1.0}, map[string]interface{}{"a": "1"}, false},
+		{map[string]interface{}{"a": 1.0}, map[string]interface{}{"a": 1.0, "b": nil}, false},
+		{[]int{1, 2, 3}, []interface{}{1.0, 2.0, 3.0}, true},
+		{[]interface{}{1.0, 2.0}, []interface{}{2.0, 1.0}, false},
+	}
+	for _, c := range cases {
+		assert.Equal(t, c.equal, jsonValueEqual(c.a, c.b), "%#v == %#v", c.a, c.b)
+	}
+}
+
+func TestPrerequisiteValueTypes(t *testing.T) {
+	jsonStr := `
+{
+	"toggles": {
+		"string_toggle": {"key": "string_toggle", "enabled": true, "version": 1,
+			"disabledServe": {"select": 0}, "defaultServe": {"select": 0}, "rules": [], "variations": ["true"]},
+		"number_toggle": {"key": "number_toggle", "enabled": true, "version": 1,
+			"disabledServe": {"select": 0}, "defaultServe": {"select": 0}, "rules": [], "variations": [1]},
+		"bool_toggle": {"key": "bool_toggle", "enabled": true, "version": 1,
+			"disabledServe": {"select": 0}, "defaultServe": {"select": 0}, "rules": [], "variations": [true]},
+		"json_toggle": {"key": "json_toggle", "enabled": true, "version": 1,
+			"disabledServe": {"select": 0}, "defaultServe": {"select": 0}, "rules": [],
+			"variations": [{"a": 1, "b": ["x", {"c": false}]}]}
+	}
+}`
+	cases := []struct {
+		prerequisite string
+		value        interface{}
+		match        bool
+	}{
+		{"string_toggle", "true", true},
+		{"string_toggle", true, false},
+		{"number_toggle", 1.0, true},
+		{"number_toggle", 1, true},
+		{"number_toggle", "1", false},
+		{"number_toggle", 1.5, false},
+		{"bool_toggle", true, true},
+		{"bool_toggle", "true", false},
+		{"json_toggle", map[string]interface{}{"b": []interface{}{"x", map[string]interface{}{"c": false}}, "a": 1.0}, true},
+		{"json_toggle", map[string]interface{}{"a": 1.0, "b": []interface{}{"x"}}, false},
+	}
+
+	for _, c := range cases {
+		repoData := RepositoryData{}
+		err := json.Unmarshal([]byte(jsonStr), &repoData)
+		assert.Equal(t, nil, err)
+		toggle := newToggleForTest("toggle", "matched")
+		toggle.Variations = []interface{}{"not_matched", "matched"}
+		one := 1
+		toggle.DefaultServe = Serve{Select: &one}
+		toggle.Prerequisites = []Prerequisite{{Key: c.prerequisite, Value: c.value}}
+		repoData.Toggles["toggle"] = toggle
+		repo := &Repository{}
+		repo.flush(repoData)
+
+		fp := FeatureProbe{Repo: repo, Config: FPConfig{MaxPrerequisitesDeep: 5}}
+		expected := "not_matched"
+		if c.match {
+			expected = "matched"
+		}
+		assert.Equal(t, expected, fp.StrValue("toggle", NewUser(), ""), "%s %#v", c.prerequisite, c.value)
+	}
+}
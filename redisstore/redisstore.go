@@ -0,0 +1,251 @@
+// Package redisstore implements a featureprobe.DataStore on top of Redis.
+package redisstore
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+
+	featureprobe "github.com/featureprobe/server-sdk-go/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+const DefaultPrefix = "featureprobe"
+
+// RedisStore keeps toggles and segments in two Redis hashes, values are the
+// JSON documents returned by the FeatureProbe server. The debug until time and
+// a version counter are kept in a third hash of metadata.
+type RedisStore struct {
+	client   redis.UniversalClient
+	prefix   string
+	cacheTTL time.Duration
+	mu       sync.Mutex
+	// toggles and segments cached in memory, nil when not cached
+	toggles    map[string]featureprobe.Toggle
+	togglesAt  time.Time
+	segments   map[string]featureprobe.Segment
+	segmentsAt time.Time
+	// last version read, the cache is dropped when it changes
+	version uint64
+}
+
+// NewRedisStore creates a store using keys starting with prefix, reads are
+// cached in memory for cacheTTL. A zero cacheTTL disables the cache.
+func NewRedisStore(client redis.UniversalClient, prefix string, cacheTTL time.Duration) *RedisStore {
+	if len(prefix) == 0 {
+		prefix = DefaultPrefix
+	}
+	return &RedisStore{
+		client:   client,
+		prefix:   prefix,
+		cacheTTL: cacheTTL,
+	}
+}
+
+func (s *RedisStore) togglesKey() string {
+	return s.prefix + ":toggles"
+}
+
+func (s *RedisStore) segmentsKey() string {
+	return s.prefix + ":segments"
+}
+
+func (s *RedisStore) metaKey() string {
+	return s.prefix + ":meta"
+}
+
+func (s *RedisStore) Init(data featureprobe.RepositoryData) error {
+	ctx := context.Background()
+	toggles := make(map[string]interface{}, len(data.Toggles))
+	for key, toggle := range data.Toggles {
+		bytes, err := json.Marshal(toggle)
+		if err != nil {
+			return err
+		}
+		toggles[key] = bytes
+	}
+	segments := make(map[string]interface{}, len(data.Segments))
+	for key, segment := range data.Segments {
+		bytes, err := json.Marshal(segment)
+		if err != nil {
+			return err
+		}
+		segments[key] = bytes
+	}
+
+	_, err := s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Del(ctx, s.togglesKey(), s.segmentsKey())
+		if len(toggles) > 0 {
+			pipe.HSet(ctx, s.togglesKey(), toggles)
+		}
+		if len(segments) > 0 {
+			pipe.HSet(ctx, s.segmentsKey(), segments)
+		}
+		pipe.HSet(ctx, s.metaKey(), "debugUntilTime", data.DebugUntilTime)
+		pipe.HIncrBy(ctx, s.metaKey(), "version", 1)
+		return nil
+	})
+	s.invalidate()
+	return err
+}
+
+func (s *RedisStore) GetToggle(key string) (featureprobe.Toggle, bool, error) {
+	if s.cacheTTL > 0 {
+		toggles, err := s.GetToggles()
+		if err != nil {
+			return featureprobe.Toggle{}, false, err
+		}
+		toggle, ok := toggles[key]
+		return toggle, ok, nil
+	}
+
+	bytes, err := s.client.HGet(context.Background(), s.togglesKey(), key).Bytes()
+	if err == redis.Nil {
+		return featureprobe.Toggle{}, false, nil
+	}
+	if err != nil {
+		return featureprobe.Toggle{}, false, err
+	}
+	var toggle featureprobe.Toggle
+	if err := json.Unmarshal(bytes, &toggle); err != nil {
+		return featureprobe.Toggle{}, false, err
+	}
+	return toggle, true, nil
+}
+
+func (s *RedisStore) GetToggles() (map[string]featureprobe.Toggle, error) {
+	s.mu.Lock()
+	if s.toggles != nil && time.Since(s.togglesAt) < s.cacheTTL {
+		toggles := s.toggles
+		s.mu.Unlock()
+		return toggles, nil
+	}
+	s.mu.Unlock()
+
+	values, err := s.client.HGetAll(context.Background(), s.togglesKey()).Result()
+	if err != nil {
+		return nil, err
+	}
+	toggles := make(map[string]featureprobe.Toggle, len(values))
+	for key, value := range values {
+		var toggle featureprobe.Toggle
+		if err := json.Unmarshal([]byte(value), &toggle); err != nil {
+			return nil, err
+		}
+		toggles[key] = toggle
+	}
+
+	if s.cacheTTL > 0 {
+		s.mu.Lock()
+		s.toggles, s.togglesAt = toggles, time.Now()
+		s.mu.Unlock()
+	}
+	return toggles, nil
+}
+
+func (s *RedisStore) GetSegments() (map[string]featureprobe.Segment, error) {
+	s.mu.Lock()
+	if s.segments != nil && time.Since(s.segmentsAt) < s.cacheTTL {
+		segments := s.segments
+		s.mu.Unlock()
+		return segments, nil
+	}
+	s.mu.Unlock()
+
+	values, err := s.client.HGetAll(context.Background(), s.segmentsKey()).Result()
+	if err != nil {
+		return nil, err
+	}
+	segments := make(map[string]featureprobe.Segment, len(values))
+	for key, value := range values {
+		var segment featureprobe.Segment
+		if err := json.Unmarshal([]byte(value), &segment); err != nil {
+			return nil, err
+		}
+		segments[key] = segment
+	}
+
+	if s.cacheTTL > 0 {
+		s.mu.Lock()
+		s.segments, s.segmentsAt = segments, time.Now()
+		s.mu.Unlock()
+	}
+	return segments, nil
+}
+
+func (s *RedisStore) GetDebugUntilTime() (uint64, error) {
+	debugUntilTime, err := s.client.HGet(context.Background(), s.metaKey(), "debugUntilTime").Uint64()
+	if err == redis.Nil {
+		return 0, nil
+	}
+	return debugUntilTime, err
+}
+
+func (s *RedisStore) Upsert(toggle featureprobe.Toggle) error {
+	ctx := context.Background()
+	key := s.togglesKey()
+	bytes, err := json.Marshal(toggle)
+	if err != nil {
+		return err
+	}
+
+	err = s.client.Watch(ctx, func(tx *redis.Tx) error {
+		stored, err := tx.HGet(ctx, key, toggle.Key).Bytes()
+		if err != nil && err != redis.Nil {
+			return err
+		}
+		if err == nil {
+			var old featureprobe.Toggle
+			if json.Unmarshal(stored, &old) == nil && old.Version > toggle.Version {
+				return nil
+			}
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.HSet(ctx, key, toggle.Key, bytes)
+			pipe.HIncrBy(ctx, s.metaKey(), "version", 1)
+			return nil
+		})
+		return err
+	}, key)
+	s.invalidate()
+	return err
+}
+
+func (s *RedisStore) Delete(key string) error {
+	ctx := context.Background()
+	_, err := s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HDel(ctx, s.togglesKey(), key)
+		pipe.HIncrBy(ctx, s.metaKey(), "version", 1)
+		return nil
+	})
+	s.invalidate()
+	return err
+}
+
+// Version reads the version counter, the in-memory cache is dropped when
+// another instance changed the store so the next reads are up to date.
+func (s *RedisStore) Version() (uint64, error) {
+	version, err := s.client.HGet(context.Background(), s.metaKey(), "version").Uint64()
+	if err == redis.Nil {
+		version, err = 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	s.mu.Lock()
+	if version != s.version {
+		s.version = version
+		s.toggles = nil
+		s.segments = nil
+	}
+	s.mu.Unlock()
+	return version, nil
+}
+
+func (s *RedisStore) invalidate() {
+	s.mu.Lock()
+	s.toggles = nil
+	s.segments = nil
+	s.mu.Unlock()
+}
@@ -0,0 +1,151 @@
+package redisstore
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	featureprobe "github.com/featureprobe/server-sdk-go/v2"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+)
+
+func setup(t *testing.T, cacheTTL time.Duration) (*miniredis.Miniredis, *RedisStore, featureprobe.RepositoryData) {
+	server := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	store := NewRedisStore(client, "", cacheTTL)
+
+	bytes, _ := ioutil.ReadFile("../resources/fixtures/repo.json")
+	repoData := featureprobe.RepositoryData{}
+	err := json.Unmarshal(bytes, &repoData)
+	assert.Equal(t, nil, err)
+	return server, store, repoData
+}
+
+func TestInitAndGet(t *testing.T) {
+	_, store, repoData := setup(t, 0)
+
+	err := store.Init(repoData)
+	assert.Equal(t, nil, err)
+
+	toggles, err := store.GetToggles()
+	assert.Equal(t, nil, err)
+	assert.Equal(t, repoData.Toggles, toggles)
+
+	segments, err := store.GetSegments()
+	assert.Equal(t, nil, err)
+	assert.Equal(t, repoData.Segments, segments)
+
+	toggle, ok, err := store.GetToggle("bool_toggle")
+	assert.Equal(t, nil, err)
+	assert.True(t, ok)
+	assert.Equal(t, repoData.Toggles["bool_toggle"], toggle)
+
+	_, ok, err = store.GetToggle("not_exist_toggle")
+	assert.Equal(t, nil, err)
+	assert.False(t, ok)
+}
+
+func TestUpsert(t *testing.T) {
+	_, store, repoData := setup(t, 0)
+	_ = store.Init(repoData)
+
+	toggle := repoData.Toggles["bool_toggle"]
+	toggle.Version = 0
+	toggle.Enabled = false
+	err := store.Upsert(toggle)
+	assert.Equal(t, nil, err)
+	stored, _, _ := store.GetToggle("bool_toggle")
+	assert.True(t, stored.Enabled)
+
+	toggle.Version = 100
+	err = store.Upsert(toggle)
+	assert.Equal(t, nil, err)
+	stored, _, _ = store.GetToggle("bool_toggle")
+	assert.False(t, stored.Enabled)
+}
+
+func TestDelete(t *testing.T) {
+	_, store, repoData := setup(t, 0)
+	_ = store.Init(repoData)
+
+	err := store.Delete("bool_toggle")
+	assert.Equal(t, nil, err)
+	_, ok, _ := store.GetToggle("bool_toggle")
+	assert.False(t, ok)
+}
+
+func TestDebugUntilTime(t *testing.T) {
+	_, store, repoData := setup(t, 0)
+
+	debugUntilTime, err := store.GetDebugUntilTime()
+	assert.Equal(t, nil, err)
+	assert.Equal(t, uint64(0), debugUntilTime)
+
+	repoData.DebugUntilTime = 1700000000000
+	_ = store.Init(repoData)
+	debugUntilTime, err = store.GetDebugUntilTime()
+	assert.Equal(t, nil, err)
+	assert.Equal(t, repoData.DebugUntilTime, debugUntilTime)
+}
+
+func TestVersion(t *testing.T) {
+	server, store, repoData := setup(t, time.Minute)
+
+	version, err := store.Version()
+	assert.Equal(t, nil, err)
+	assert.Equal(t, uint64(0), version)
+
+	_ = store.Init(repoData)
+	toggle := repoData.Toggles["bool_toggle"]
+	toggle.Version++
+	_ = store.Upsert(toggle)
+	_ = store.Delete("string_toggle")
+	version, _ = store.Version()
+	assert.Equal(t, uint64(3), version)
+
+	// another instance changing the store drops the cache
+	_, ok, _ := store.GetToggle("bool_toggle")
+	assert.True(t, ok)
+	server.HDel("featureprobe:toggles", "bool_toggle")
+	server.HIncrBy("featureprobe:meta", "version", 1)
+	version, _ = store.Version()
+	assert.Equal(t, uint64(4), version)
+	_, ok, _ = store.GetToggle("bool_toggle")
+	assert.False(t, ok)
+}
+
+func TestCacheTTL(t *testing.T) {
+	server, store, repoData := setup(t, time.Minute)
+	_ = store.Init(repoData)
+
+	_, ok, _ := store.GetToggle("bool_toggle")
+	assert.True(t, ok)
+
+	server.Del("featureprobe:toggles")
+	_, ok, _ = store.GetToggle("bool_toggle")
+	assert.True(t, ok)
+
+	store.invalidate()
+	_, ok, _ = store.GetToggle("bool_toggle")
+	assert.False(t, ok)
+}
+
+func TestDaemonMode(t *testing.T) {
+	_, store, repoData := setup(t, time.Second)
+	_ = store.Init(repoData)
+
+	fp := featureprobe.NewFeatureProbe(featureprobe.FPConfig{
+		RemoteUrl:       "http://localhost/",
+		RefreshInterval: 100 * time.Millisecond,
+		DataStore:       store,
+		DaemonMode:      true,
+	})
+	defer fp.Close()
+
+	assert.True(t, fp.Initialized())
+	user := featureprobe.NewUser().StableRollout("key11").With("city", "4")
+	assert.Equal(t, "2", fp.StrValue("string_toggle", user, "1"))
+}
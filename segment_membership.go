@@ -0,0 +1,243 @@
+package featureprobe
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	defaultSegmentMembershipCacheTTL   = 5 * time.Second
+	defaultSegmentMembershipStaleAfter = 2 * time.Minute
+	defaultSegmentMembershipCacheUsers = 1000
+)
+
+// SegmentMembership tells the unbounded segments a user is in, keyed by
+// segment unique id: true when included and false when excluded. Segments
+// missing from it are evaluated with their rules.
+type SegmentMembership map[string]bool
+
+// SegmentMembershipStore looks up the membership of users in unbounded
+// segments, whose users are too many to be listed in segment rules. Users are
+// identified by their hashed key so stores never hold raw user keys.
+// Implementations must be safe for concurrent use.
+type SegmentMembershipStore interface {
+	// GetMembership returns the membership of the user whose key hashes to
+	// hashedUserKey, see HashSegmentUserKey.
+	GetMembership(hashedUserKey string) (SegmentMembership, error)
+	// LastUpdated returns when the store was last synchronized with the
+	// segments, zero when unknown.
+	LastUpdated() (time.Time, error)
+}
+
+// HashSegmentUserKey hashes a user key the way SegmentMembershipStore
+// implementations index users: base64 encoded SHA-256.
+func HashSegmentUserKey(userKey string) string {
+	sum := sha256.Sum256([]byte(userKey))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// segmentMembershipCache caches the membership of recently evaluated users in
+// front of a SegmentMembershipStore.
+type segmentMembershipCache struct {
+	store      SegmentMembershipStore
+	ttl        time.Duration
+	staleAfter time.Duration
+	maxUsers   int
+	clock      Clock
+
+	mu    sync.Mutex
+	users map[string]cachedSegmentMembership
+}
+
+type cachedSegmentMembership struct {
+	membership SegmentMembership
+	stale      bool
+	expires    time.Time
+}
+
+// newSegmentMembershipCache returns nil when config has no
+// SegmentMembershipStore.
+func newSegmentMembershipCache(config FPConfig) *segmentMembershipCache {
+	if config.SegmentMembershipStore == nil {
+		return nil
+	}
+	cache := &segmentMembershipCache{
+		store:      config.SegmentMembershipStore,
+		ttl:        config.SegmentMembershipCacheTTL,
+		staleAfter: config.SegmentMembershipStaleAfter,
+		maxUsers:   defaultSegmentMembershipCacheUsers,
+		clock:      config.Clock,
+		users:      map[string]cachedSegmentMembership{},
+	}
+	if cache.ttl <= 0 {
+		cache.ttl = defaultSegmentMembershipCacheTTL
+	}
+	if cache.staleAfter <= 0 {
+		cache.staleAfter = defaultSegmentMembershipStaleAfter
+	}
+	if cache.clock == nil {
+		cache.clock = systemClock{}
+	}
+	return cache
+}
+
+// get returns the membership of the user of userKey, stale is true when the
+// store failed or was not synchronized recently.
+func (c *segmentMembershipCache) get(userKey string) (membership SegmentMembership, stale bool) {
+	now := c.clock.Now()
+	c.mu.Lock()
+	cached, ok := c.users[userKey]
+	c.mu.Unlock()
+	if ok && now.Before(cached.expires) {
+		return cached.membership, cached.stale
+	}
+
+	membership, err := c.store.GetMembership(HashSegmentUserKey(userKey))
+	if err != nil {
+		fmt.Printf("segment membership store get membership err: %s\n", err)
+		stale = true
+	} else {
+		updated, err := c.store.LastUpdated()
+		if err != nil {
+			fmt.Printf("segment membership store last updated err: %s\n", err)
+		}
+		stale = err != nil || (!updated.IsZero() && now.Sub(updated) > c.staleAfter)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.users) >= c.maxUsers {
+		c.evict(now)
+	}
+	c.users[userKey] = cachedSegmentMembership{membership: membership, stale: stale, expires: now.Add(c.ttl)}
+	return membership, stale
+}
+
+// evict removes the expired users, or an arbitrary one when none is expired.
+func (c *segmentMembershipCache) evict(now time.Time) {
+	for key, cached := range c.users {
+		if !now.Before(cached.expires) {
+			delete(c.users, key)
+		}
+	}
+	for key := range c.users {
+		if len(c.users) < c.maxUsers {
+			return
+		}
+		delete(c.users, key)
+	}
+}
+
+// segmentMembershipLookup queries the membership of the evaluated user at
+// most once per evaluation, and remembers whether it was stale.
+type segmentMembershipLookup struct {
+	cache      *segmentMembershipCache
+	userKey    string
+	loaded     bool
+	membership SegmentMembership
+	stale      bool
+}
+
+// contains tells whether the user is included in or excluded from the
+// unbounded segment of segmentKey, ok is false when the membership is unknown.
+// Without a store every lookup is stale.
+func (l *segmentMembershipLookup) contains(segmentKey string) (included bool, ok bool) {
+	if l == nil {
+		return false, false
+	}
+	if l.cache == nil {
+		l.stale = true
+		return false, false
+	}
+	if !l.loaded {
+		l.membership, l.stale = l.cache.get(l.userKey)
+		l.loaded = true
+	}
+	included, ok = l.membership[segmentKey]
+	return included, ok
+}
+
+// SegmentKeySet lists the hashed keys of the users included in and excluded
+// from a segment, see HashSegmentUserKey.
+type SegmentKeySet struct {
+	Included []string `json:"included"`
+	Excluded []string `json:"excluded"`
+}
+
+// KeySetMembershipStore is a SegmentMembershipStore keeping the hashed user
+// keys of unbounded segments in memory, e.g. loaded from a file exported by a
+// data pipeline.
+type KeySetMembershipStore struct {
+	mu      sync.RWMutex
+	users   map[string]SegmentMembership
+	updated time.Time
+}
+
+func NewKeySetMembershipStore() *KeySetMembershipStore {
+	return &KeySetMembershipStore{users: map[string]SegmentMembership{}}
+}
+
+// Replace replaces the key sets of all segments, keyed by segment unique id.
+// A user both included in and excluded from a segment is excluded.
+func (s *KeySetMembershipStore) Replace(segments map[string]SegmentKeySet, updated time.Time) {
+	users := map[string]SegmentMembership{}
+	set := func(hashedKey, segmentKey string, included bool) {
+		if users[hashedKey] == nil {
+			users[hashedKey] = SegmentMembership{}
+		}
+		users[hashedKey][segmentKey] = included
+	}
+	for segmentKey, keySet := range segments {
+		for _, hashedKey := range keySet.Included {
+			set(hashedKey, segmentKey, true)
+		}
+		for _, hashedKey := range keySet.Excluded {
+			set(hashedKey, segmentKey, false)
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.users = users
+	s.updated = updated
+}
+
+// LoadFile replaces the key sets with the ones of a JSON file like
+// {"updatedAt": 1700000000000, "segments": {"<unique id>": {"included": [], "excluded": []}}},
+// updatedAt being in milliseconds.
+func (s *KeySetMembershipStore) LoadFile(path string) error {
+	bytes, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var file struct {
+		UpdatedAt int64                    `json:"updatedAt"`
+		Segments  map[string]SegmentKeySet `json:"segments"`
+	}
+	if err := json.Unmarshal(bytes, &file); err != nil {
+		return err
+	}
+	var updated time.Time
+	if file.UpdatedAt > 0 {
+		updated = time.UnixMilli(file.UpdatedAt)
+	}
+	s.Replace(file.Segments, updated)
+	return nil
+}
+
+func (s *KeySetMembershipStore) GetMembership(hashedUserKey string) (SegmentMembership, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.users[hashedUserKey], nil
+}
+
+func (s *KeySetMembershipStore) LastUpdated() (time.Time, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.updated, nil
+}
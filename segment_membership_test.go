@@ -0,0 +1,164 @@
+package featureprobe
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type countingMembershipStore struct {
+	store   *KeySetMembershipStore
+	err     error
+	queries int
+}
+
+func (s *countingMembershipStore) GetMembership(hashedUserKey string) (SegmentMembership, error) {
+	s.queries++
+	if s.err != nil {
+		return nil, s.err
+	}
+	return s.store.GetMembership(hashedUserKey)
+}
+
+func (s *countingMembershipStore) LastUpdated() (time.Time, error) {
+	return s.store.LastUpdated()
+}
+
+func setupUnboundedSegmentToggle(store SegmentMembershipStore, clock Clock) *FeatureProbe {
+	on, off := 0, 1
+	repo := &Repository{}
+	repo.flush(RepositoryData{
+		Toggles: map[string]Toggle{
+			"beta_toggle": {
+				Key:           "beta_toggle",
+				Enabled:       true,
+				Version:       1,
+				DisabledServe: Serve{Select: &off},
+				DefaultServe:  Serve{Select: &off},
+				Rules: []Rule{{
+					Serve: Serve{Select: &on},
+					Conditions: []Condition{{
+						Type:      "segment",
+						Predicate: "is in",
+						Objects:   []string{"beta_users"},
+					}},
+				}},
+				Variations: []interface{}{true, false},
+			},
+		},
+		Segments: map[string]Segment{
+			"beta_users": {
+				Key:       "beta_users",
+				UniqId:    "beta_users",
+				Unbounded: true,
+				Rules: []Rule{{Conditions: []Condition{
+					{Type: "string", Subject: "email", Predicate: "ends with", Objects: []string{"@company.com"}},
+				}}},
+			},
+		},
+	})
+	config := FPConfig{MaxPrerequisitesDeep: 5, Clock: clock, SegmentMembershipStore: store}
+	return &FeatureProbe{Repo: repo, Config: config, segmentMemberships: newSegmentMembershipCache(config)}
+}
+
+func TestHashSegmentUserKey(t *testing.T) {
+	assert.Equal(t, "LPJNul+wow4m6DsqxbninhsWHlwfp0JecwQzYpOLmCQ=", HashSegmentUserKey("hello"))
+}
+
+func TestKeySetMembershipStore(t *testing.T) {
+	store := NewKeySetMembershipStore()
+	store.Replace(map[string]SegmentKeySet{
+		"beta":  {Included: []string{HashSegmentUserKey("u1"), HashSegmentUserKey("u2")}},
+		"alpha": {Included: []string{HashSegmentUserKey("u1")}, Excluded: []string{HashSegmentUserKey("u1")}},
+	}, launchTime)
+
+	membership, err := store.GetMembership(HashSegmentUserKey("u1"))
+	assert.Nil(t, err)
+	assert.Equal(t, SegmentMembership{"beta": true, "alpha": false}, membership)
+	membership, _ = store.GetMembership(HashSegmentUserKey("u3"))
+	assert.Empty(t, membership)
+	updated, _ := store.LastUpdated()
+	assert.Equal(t, launchTime, updated)
+}
+
+func TestKeySetMembershipStoreLoadFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "segments.json")
+	content := `{"updatedAt": 1700000000000, "segments": {"beta": {"included": ["` + HashSegmentUserKey("u1") + `"]}}}`
+	assert.Nil(t, os.WriteFile(path, []byte(content), 0600))
+
+	store := NewKeySetMembershipStore()
+	assert.Nil(t, store.LoadFile(path))
+	membership, _ := store.GetMembership(HashSegmentUserKey("u1"))
+	assert.Equal(t, SegmentMembership{"beta": true}, membership)
+	updated, _ := store.LastUpdated()
+	assert.Equal(t, time.UnixMilli(1700000000000), updated)
+
+	assert.NotNil(t, store.LoadFile(filepath.Join(t.TempDir(), "missing.json")))
+}
+
+func TestUnboundedSegment(t *testing.T) {
+	keySets := NewKeySetMembershipStore()
+	keySets.Replace(map[string]SegmentKeySet{"beta_users": {
+		Included: []string{HashSegmentUserKey("insider")},
+		Excluded: []string{HashSegmentUserKey("leaver")},
+	}}, launchTime)
+	fp := setupUnboundedSegmentToggle(keySets, &fixedClock{now: launchTime})
+
+	detail := fp.BoolDetail("beta_toggle", NewUser().StableRollout("insider"), false)
+	assert.True(t, detail.Value)
+	assert.False(t, detail.SegmentMembershipStale)
+	// excluded by the store whatever the segment rules
+	leaver := NewUser().StableRollout("leaver").With("email", "leaver@company.com")
+	assert.False(t, fp.BoolValue("beta_toggle", leaver, true))
+	// unknown to the store, evaluated with the segment rules
+	staff := NewUser().StableRollout("staff").With("email", "staff@company.com")
+	assert.True(t, fp.BoolValue("beta_toggle", staff, false))
+	assert.False(t, fp.BoolValue("beta_toggle", NewUser().StableRollout("other"), true))
+}
+
+func TestSegmentMembershipCache(t *testing.T) {
+	keySets := NewKeySetMembershipStore()
+	keySets.Replace(map[string]SegmentKeySet{"beta_users": {Included: []string{HashSegmentUserKey("insider")}}},
+		launchTime)
+	store := &countingMembershipStore{store: keySets}
+	clock := &fixedClock{now: launchTime}
+	fp := setupUnboundedSegmentToggle(store, clock)
+	user := NewUser().StableRollout("insider")
+
+	assert.True(t, fp.BoolValue("beta_toggle", user, false))
+	assert.True(t, fp.BoolValue("beta_toggle", user, false))
+	assert.Equal(t, 1, store.queries)
+
+	keySets.Replace(map[string]SegmentKeySet{}, launchTime)
+	clock.now = launchTime.Add(defaultSegmentMembershipCacheTTL)
+	assert.False(t, fp.BoolValue("beta_toggle", user, true))
+	assert.Equal(t, 2, store.queries)
+}
+
+func TestSegmentMembershipStale(t *testing.T) {
+	keySets := NewKeySetMembershipStore()
+	keySets.Replace(map[string]SegmentKeySet{"beta_users": {Included: []string{HashSegmentUserKey("insider")}}},
+		launchTime)
+	store := &countingMembershipStore{store: keySets}
+	clock := &fixedClock{now: launchTime.Add(defaultSegmentMembershipStaleAfter + time.Second)}
+	fp := setupUnboundedSegmentToggle(store, clock)
+
+	detail := fp.BoolDetail("beta_toggle", NewUser().StableRollout("insider"), false)
+	assert.True(t, detail.Value)
+	assert.True(t, detail.SegmentMembershipStale)
+
+	store.err = errors.New("store unavailable")
+	staff := NewUser().StableRollout("staff").With("email", "staff@company.com")
+	detail = fp.BoolDetail("beta_toggle", staff, false)
+	assert.True(t, detail.Value)
+	assert.True(t, detail.SegmentMembershipStale)
+
+	fp = setupUnboundedSegmentToggle(nil, clock)
+	assert.True(t, fp.BoolDetail("beta_toggle", staff, false).SegmentMembershipStale)
+	other := NewUser().StableRollout("other")
+	assert.False(t, fp.BoolDetail("other_toggle", other, false).SegmentMembershipStale)
+}
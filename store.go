@@ -0,0 +1,105 @@
+package featureprobe
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// ToggleStore holds the toggles and segments a Repository evaluates against.
+// Implementations must be safe for concurrent use.
+type ToggleStore interface {
+	// Get returns the toggle of key, ok is false if it does not exist.
+	Get(key string) (toggle Toggle, ok bool)
+	// All returns all the toggles keyed by toggle key, callers must not modify it.
+	All() map[string]Toggle
+	// Segments returns all the segments keyed by segment unique id, callers
+	// must not modify it.
+	Segments() map[string]Segment
+	// Apply replaces all the toggles and segments with data.
+	Apply(data RepositoryData)
+	// Upsert stores toggle unless a toggle with a newer version is stored.
+	Upsert(toggle Toggle)
+	// Delete removes the toggle of key.
+	Delete(key string)
+	// Version increases every time the stored data changes.
+	Version() uint64
+}
+
+// MemoryStore is the default ToggleStore, it keeps immutable snapshots of the
+// data so reads never block. The zero value is an empty store.
+type MemoryStore struct {
+	mu       sync.Mutex
+	toggles  atomic.Value
+	segments atomic.Value
+	version  atomic.Uint64
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{}
+}
+
+func (m *MemoryStore) Get(key string) (Toggle, bool) {
+	toggle, ok := m.All()[key]
+	return toggle, ok
+}
+
+func (m *MemoryStore) All() map[string]Toggle {
+	toggles, ok := m.toggles.Load().(map[string]Toggle)
+	if !ok || toggles == nil {
+		return make(map[string]Toggle)
+	}
+	return toggles
+}
+
+func (m *MemoryStore) Segments() map[string]Segment {
+	segments, ok := m.segments.Load().(map[string]Segment)
+	if !ok || segments == nil {
+		return make(map[string]Segment)
+	}
+	return segments
+}
+
+func (m *MemoryStore) Apply(data RepositoryData) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.toggles.Store(data.Toggles)
+	m.segments.Store(data.Segments)
+	m.version.Add(1)
+}
+
+func (m *MemoryStore) Upsert(toggle Toggle) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	old := m.All()
+	if stored, ok := old[toggle.Key]; ok && stored.Version > toggle.Version {
+		return
+	}
+	toggles := make(map[string]Toggle, len(old)+1)
+	for key, t := range old {
+		toggles[key] = t
+	}
+	toggles[toggle.Key] = toggle
+	m.toggles.Store(toggles)
+	m.version.Add(1)
+}
+
+func (m *MemoryStore) Delete(key string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	old := m.All()
+	if _, ok := old[key]; !ok {
+		return
+	}
+	toggles := make(map[string]Toggle, len(old))
+	for k, t := range old {
+		if k != key {
+			toggles[k] = t
+		}
+	}
+	m.toggles.Store(toggles)
+	m.version.Add(1)
+}
+
+func (m *MemoryStore) Version() uint64 {
+	return m.version.Load()
+}
@@ -6,28 +6,36 @@ import (
 	"io/ioutil"
 	"net/http"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type Synchronizer struct {
 	auth               string
+	headers            http.Header
+	userAgent          string
 	togglesUrl         string
 	RefreshInterval    time.Duration
 	repository         *Repository
+	daemon             bool
+	dataStore          DataStore
+	dataStoreVersion   uint64
+	dataStoreLoaded    bool
 	httpClient         http.Client
 	mu                 sync.Mutex
 	startOnce          sync.Once
 	stopOnce           sync.Once
 	setInitializedOnce sync.Once
-	isInitialized      bool
+	isInitialized      atomic.Bool
 	stopChan           chan struct{}
 	ticker             *time.Ticker
 	enablePolling      bool
 }
 
-func NewSynchronizer(url string, RefreshInterval time.Duration, auth string, repo *Repository) Synchronizer {
-	return Synchronizer{
+func NewSynchronizer(url string, RefreshInterval time.Duration, auth string, repo *Repository) *Synchronizer {
+	return &Synchronizer{
 		auth:            auth,
+		userAgent:       USER_AGENT,
 		togglesUrl:      url,
 		RefreshInterval: RefreshInterval,
 		httpClient:      newHttpClient(RefreshInterval),
@@ -37,14 +45,28 @@ func NewSynchronizer(url string, RefreshInterval time.Duration, auth string, rep
 	}
 }
 
-func NewCustomRepoSynchronizer(repo *Repository) Synchronizer {
-	return Synchronizer{
+func NewCustomRepoSynchronizer(repo *Repository) *Synchronizer {
+	return &Synchronizer{
 		repository:    repo,
 		stopChan:      make(chan struct{}),
 		enablePolling: false,
 	}
 }
 
+// NewDataStoreSynchronizer reads the toggles of repo from store every
+// RefreshInterval instead of fetching them from the FeatureProbe server, it
+// never starts without a store.
+func NewDataStoreSynchronizer(store DataStore, RefreshInterval time.Duration, repo *Repository) *Synchronizer {
+	return &Synchronizer{
+		RefreshInterval: RefreshInterval,
+		repository:      repo,
+		daemon:          true,
+		dataStore:       store,
+		stopChan:        make(chan struct{}),
+		enablePolling:   true,
+	}
+}
+
 func (s *Synchronizer) Start(ready chan<- struct{}) {
 	var readyOnce sync.Once
 	notifyReady := func() {
@@ -53,11 +75,28 @@ func (s *Synchronizer) Start(ready chan<- struct{}) {
 		})
 	}
 	if !s.enablePolling {
-		s.isInitialized = true
+		s.isInitialized.Store(true)
 		notifyReady()
 		return
 	}
 	s.startOnce.Do(func() {
+		if s.daemon && s.dataStore == nil {
+			fmt.Printf("FP daemon mode requires a DataStore, toggles are not synced\n")
+			return
+		}
+		poll := func() {
+			if s.fetch() == nil {
+				s.setInitializedOnce.Do(func() {
+					// first sync success
+					s.isInitialized.Store(true)
+					notifyReady()
+				})
+			}
+		}
+		if s.daemon {
+			// reading the data store is cheap, don't wait for the first tick
+			poll()
+		}
 		s.ticker = time.NewTicker(s.RefreshInterval)
 		go func() {
 			for {
@@ -65,14 +104,7 @@ func (s *Synchronizer) Start(ready chan<- struct{}) {
 				case <-s.stopChan:
 					return
 				case <-s.ticker.C:
-					err := s.FetchRemoteRepo()
-					if err == nil {
-						s.setInitializedOnce.Do(func() {
-							// first sync success
-							s.isInitialized = true
-							notifyReady()
-						})
-					}
+					poll()
 				}
 			}
 		}()
@@ -81,18 +113,50 @@ func (s *Synchronizer) Start(ready chan<- struct{}) {
 
 // Initialized return false means not successfully fetch remote resource
 func (s *Synchronizer) Initialized() bool {
-	return s.isInitialized
+	return s.isInitialized.Load()
 }
 
 func (s *Synchronizer) Stop() {
 	if s.stopChan != nil {
 		s.stopOnce.Do(func() {
 			close(s.stopChan)
-			s.isInitialized = false
+			s.isInitialized.Store(false)
 		})
 	}
 }
 
+func (s *Synchronizer) fetch() error {
+	if s.daemon {
+		return s.FetchDataStore()
+	}
+	return s.FetchRemoteRepo()
+}
+
+// FetchDataStore reads the data store and updates local repo when the store
+// version changed, toggles are compiled and validated as if they were fetched
+// from the server.
+func (s *Synchronizer) FetchDataStore() error {
+	version, err := s.dataStore.Version()
+	if err != nil {
+		fmt.Printf("%s\n", err)
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.dataStoreLoaded && version == s.dataStoreVersion {
+		return nil
+	}
+	// changes made after reading version are picked up by the next fetch
+	data, err := loadDataStore(s.dataStore)
+	if err != nil {
+		fmt.Printf("%s\n", err)
+		return err
+	}
+	s.repository.flush(data)
+	s.dataStoreVersion, s.dataStoreLoaded = version, true
+	return nil
+}
+
 // FetchRemoteRepo fetch remote repo and update local repo
 func (s *Synchronizer) FetchRemoteRepo() error {
 	req, err := http.NewRequest(http.MethodGet, s.togglesUrl, nil)
@@ -102,8 +166,7 @@ func (s *Synchronizer) FetchRemoteRepo() error {
 		return err
 	}
 
-	req.Header.Add("Authorization", s.auth)
-	req.Header.Add("User-Agent", USER_AGENT)
+	setRequestHeaders(req, s.headers, s.auth, s.userAgent)
 	s.mu.Lock()
 	resp, err := s.httpClient.Do(req)
 	s.mu.Unlock()
@@ -117,7 +180,10 @@ func (s *Synchronizer) FetchRemoteRepo() error {
 	s.mu.Lock()
 	repoData := RepositoryData{}
 	err = json.Unmarshal(bodyBytes, &repoData)
-	s.repository.flush(repoData)
+	if err == nil {
+		// an invalid response must not wipe a data store shared with other instances
+		s.repository.flush(repoData)
+	}
 	s.mu.Unlock()
 	if err != nil {
 		fmt.Printf("%s\n", err)
@@ -28,7 +28,8 @@ func TestSyncInitSuccess(t *testing.T) {
 	assert.True(t, synchronizer.Initialized())
 
 	synchronizer.mu.Lock() // for go test -race
-	assert.Equal(t, repo, repo2)
+	assert.Equal(t, repo.getToggles(), repo2.getToggles())
+	assert.Equal(t, repo.getSegments(), repo2.getSegments())
 	httpmock.DeactivateAndReset()
 	synchronizer.mu.Unlock()
 }
@@ -91,8 +92,8 @@ func TestSyncInvalidUrl(t *testing.T) {
 	//TODO: check error
 }
 
-func setup(t *testing.T) (Repository, string) {
-	var repo Repository
+func setup(t *testing.T) (*Repository, string) {
+	repo := &Repository{}
 	bytes, _ := ioutil.ReadFile("./resources/fixtures/repo.json")
 	jsonStr := string(bytes)
 	repoData := RepositoryData{}
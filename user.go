@@ -1,21 +1,43 @@
 package featureprobe
 
 import (
+	"fmt"
+	"reflect"
+	"sort"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
+
+	"github.com/google/uuid"
 )
 
+// FPUser attributes keep the type they were set with: string, float64, bool,
+// time.Time or []string.
+//
+// An FPUser is immutable, the With methods return an updated copy and leave
+// the user they are called on untouched, so users can be shared between
+// goroutines and used as a base for other users. A user without
+// StableRollout key gets a random key, users derived from it by the With
+// methods get their own random key. Only users created by NewUser keep that
+// key, see Key.
 type FPUser struct {
-	mu    *sync.RWMutex
-	key   string
-	attrs map[string]string
+	key      string
+	anonKey  *anonymousKey
+	attrs    map[string]interface{}
+	private  map[string]struct{}
+	contexts map[string]FPUser
+	// evalTime is the time conditions are evaluated at, set by FeatureProbe
+	// for each evaluation. The zero time means the time of the evaluation.
+	evalTime time.Time
+	// memberships looks up the unbounded segments of the user, set by
+	// FeatureProbe for each evaluation.
+	memberships *segmentMembershipLookup
 }
 
 func NewUser() FPUser {
 	return FPUser{
-		mu:    &sync.RWMutex{},
-		attrs: map[string]string{},
+		anonKey: &anonymousKey{},
 	}
 }
 
@@ -24,56 +46,467 @@ func (u FPUser) StableRollout(key string) FPUser {
 	return u
 }
 
+// anonymousKey is generated once and shared by the copies of an FPUser.
+type anonymousKey struct {
+	once sync.Once
+	key  string
+}
+
+// Key returns the StableRollout key, or else a random key generated on first
+// use and kept for the lifetime of the user. Only users created by NewUser
+// have a stable random key: a zero FPUser gets a new one on every call, so
+// each evaluation or Track of it is recorded under a different user id.
 func (u FPUser) Key() string {
 	if len(u.key) == 0 {
-		u.key = u.generateKey()
+		if u.anonKey == nil {
+			return uuid.New().String()
+		}
+		u.anonKey.once.Do(func() {
+			u.anonKey.key = uuid.New().String()
+		})
+		return u.anonKey.key
 	}
 	return u.key
 }
 
-func (u FPUser) generateKey() string {
-	current := time.Now().UnixNano()
-	return strconv.FormatInt(current, 10)
+// withAnonymousKey returns the user with a random key kept by its copies,
+// which a zero FPUser lacks.
+func (u FPUser) withAnonymousKey() FPUser {
+	if len(u.key) == 0 && u.anonKey == nil {
+		u.anonKey = &anonymousKey{}
+	}
+	return u
+}
+
+// derived returns the user the With methods start from: an anonymous user
+// gets its own random key, not the one of the user it derives from.
+func (u FPUser) derived() FPUser {
+	if len(u.key) == 0 {
+		u.anonKey = &anonymousKey{}
+	}
+	return u
+}
+
+// at returns the user evaluated at t.
+func (u FPUser) at(t time.Time) FPUser {
+	u.evalTime = t
+	return u
+}
+
+// withSegmentMemberships returns the user whose unbounded segments are looked
+// up with memberships.
+func (u FPUser) withSegmentMemberships(memberships *segmentMembershipLookup) FPUser {
+	u.memberships = memberships
+	return u
+}
+
+func (u FPUser) evaluationTime() time.Time {
+	if u.evalTime.IsZero() {
+		return time.Now()
+	}
+	return u.evalTime
+}
+
+// Anonymous reports whether the user has no StableRollout key.
+func (u FPUser) Anonymous() bool {
+	return len(u.key) == 0
 }
 
 func (u FPUser) With(key string, value string) FPUser {
-	u.mu.Lock()
-	u.attrs[key] = value
-	u.mu.Unlock()
+	return u.with(key, value, false)
+}
+
+func (u FPUser) WithNumber(key string, value float64) FPUser {
+	return u.with(key, value, false)
+}
 
+func (u FPUser) WithBool(key string, value bool) FPUser {
+	return u.with(key, value, false)
+}
+
+func (u FPUser) WithTime(key string, value time.Time) FPUser {
+	return u.with(key, value, false)
+}
+
+// WithList sets a list attribute, conditions match it if any element matches.
+func (u FPUser) WithList(key string, values []string) FPUser {
+	return u.with(key, append([]string{}, values...), false)
+}
+
+// WithPrivate sets an attribute used for evaluation but redacted from events.
+func (u FPUser) WithPrivate(key string, value string) FPUser {
+	return u.with(key, value, true)
+}
+
+func (u FPUser) with(key string, value interface{}, private bool) FPUser {
+	u = u.derived()
+	attrs := make(map[string]interface{}, len(u.attrs)+1)
+	for k, v := range u.attrs {
+		attrs[k] = v
+	}
+	attrs[key] = value
+	u.attrs = attrs
+
+	if _, marked := u.private[key]; marked != private {
+		set := make(map[string]struct{}, len(u.private)+1)
+		for k := range u.private {
+			set[k] = struct{}{}
+		}
+		if private {
+			set[key] = struct{}{}
+		} else {
+			delete(set, key)
+		}
+		u.private = set
+	}
+	return u
+}
+
+// WithContext attaches the context of another kind, e.g. an organization or a
+// device, with its own key and attributes. Conditions address its attributes
+// as "kind.attribute" and Split.BucketBy set to kind buckets by its key.
+func (u FPUser) WithContext(kind string, context FPUser) FPUser {
+	u = u.derived()
+	contexts := make(map[string]FPUser, len(u.contexts)+1)
+	for k, c := range u.contexts {
+		contexts[k] = c
+	}
+	contexts[kind] = context.withAnonymousKey()
+	u.contexts = contexts
 	return u
 }
 
+// Clone returns a copy of the user. Users are immutable so a copy is only
+// needed to hand out a user whose maps are not shared with any other.
+func (u FPUser) Clone() FPUser {
+	clone := u
+	clone.attrs = make(map[string]interface{}, len(u.attrs))
+	for k, v := range u.attrs {
+		if list, ok := v.([]string); ok {
+			v = append([]string{}, list...)
+		}
+		clone.attrs[k] = v
+	}
+	clone.private = make(map[string]struct{}, len(u.private))
+	for k := range u.private {
+		clone.private[k] = struct{}{}
+	}
+	clone.contexts = make(map[string]FPUser, len(u.contexts))
+	for k, c := range u.contexts {
+		clone.contexts[k] = c.Clone()
+	}
+	return clone
+}
+
+func (u FPUser) Context(kind string) (FPUser, bool) {
+	context, ok := u.contexts[kind]
+	return context, ok
+}
+
+// ContextKeys returns the key of each attached context by kind.
+func (u FPUser) ContextKeys() map[string]string {
+	if len(u.contexts) == 0 {
+		return nil
+	}
+	keys := make(map[string]string, len(u.contexts))
+	for kind, context := range u.contexts {
+		keys[kind] = context.Key()
+	}
+	return keys
+}
+
+// GetAll returns the attributes formatted as strings, see Get.
 func (u FPUser) GetAll() map[string]string {
-	u.mu.RLock()
 	snapshot := make(map[string]string, len(u.attrs))
 	for k, v := range u.attrs {
-		snapshot[k] = v
+		snapshot[k] = formatAttr(v)
 	}
-	u.mu.RUnlock()
-
 	return snapshot
 }
 
+// Get returns the attribute formatted as a string: numbers in their shortest
+// form, times as unix seconds and lists joined with commas.
 func (u FPUser) Get(key string) string {
-	u.mu.RLock()
-	v := u.attrs[key]
-	u.mu.RUnlock()
+	v, _ := u.GetValue(key)
+	return formatAttr(v)
+}
 
-	return v
+// GetValue returns the attribute with the type it was set with.
+func (u FPUser) GetValue(key string) (interface{}, bool) {
+	v, ok := u.attrs[key]
+	return v, ok
 }
 
 func (u FPUser) ContainAttr(key string) bool {
-	u.mu.RLock()
 	_, ok := u.attrs[key]
-	u.mu.RUnlock()
-
 	return ok
 }
 
 func (u FPUser) ToMap() map[string]interface{} {
-	return map[string]interface{}{
+	return u.toMap("", nil, nil)
+}
+
+// redactedMap returns the user as ToMap does without its private attributes:
+// those set with WithPrivate, those listed in private and all of them when
+// allPrivate. The names of the attributes left out are returned sorted.
+func (u FPUser) redactedMap(private []string, allPrivate bool) (map[string]interface{}, []string) {
+	isPrivate := func(name string) bool {
+		if allPrivate {
+			return true
+		}
+		for _, p := range private {
+			if p == name {
+				return true
+			}
+		}
+		return false
+	}
+	redacted := []string{}
+	m := u.toMap("", isPrivate, &redacted)
+	if len(redacted) == 0 {
+		return m, nil
+	}
+	sort.Strings(redacted)
+	return m, redacted
+}
+
+// toMap leaves out attributes marked private or for which isPrivate is true
+// when isPrivate is not nil, and appends their names to redacted.
+func (u FPUser) toMap(prefix string, isPrivate func(name string) bool, redacted *[]string) map[string]interface{} {
+	attrs := make(map[string]string, len(u.attrs))
+	for k, v := range u.attrs {
+		if isPrivate != nil {
+			if _, marked := u.private[k]; marked || isPrivate(prefix+k) {
+				*redacted = append(*redacted, prefix+k)
+				continue
+			}
+		}
+		attrs[k] = formatAttr(v)
+	}
+	m := map[string]interface{}{
 		"key":   u.Key(),
-		"attrs": u.GetAll(),
+		"attrs": attrs,
+	}
+	if len(u.contexts) > 0 {
+		contexts := make(map[string]interface{}, len(u.contexts))
+		for kind, context := range u.contexts {
+			contexts[kind] = context.toMap(kind+".", isPrivate, redacted)
+		}
+		m["contexts"] = contexts
+	}
+	return m
+}
+
+// lookup returns the attribute a condition subject refers to. A subject
+// names an attribute of the user, or "kind.attribute" of an attached context;
+// attributes of the user win, so "user.attribute" is the user's own one.
+func (u FPUser) lookup(subject string) (interface{}, bool) {
+	if v, ok := u.GetValue(subject); ok {
+		return v, true
+	}
+	i := strings.Index(subject, ".")
+	if i < 0 {
+		return nil, false
+	}
+	kind, attr := subject[:i], subject[i+1:]
+	if context, ok := u.Context(kind); ok {
+		return context.GetValue(attr)
+	}
+	if kind == "user" {
+		return u.GetValue(attr)
+	}
+	return nil, false
+}
+
+// bucketKey returns the key of the context of kind bucketBy, or else the
+// attribute bucketBy refers to.
+func (u FPUser) bucketKey(bucketBy string) string {
+	if _, ok := u.GetValue(bucketBy); !ok {
+		if context, ok := u.Context(bucketBy); ok {
+			return context.Key()
+		}
+	}
+	v, _ := u.lookup(bucketBy)
+	return formatAttr(v)
+}
+
+func formatAttr(v interface{}) string {
+	switch value := v.(type) {
+	case string:
+		return value
+	case float64:
+		return strconv.FormatFloat(value, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(value)
+	case time.Time:
+		return strconv.FormatInt(value.Unix(), 10)
+	case []string:
+		return strings.Join(value, ",")
+	}
+	return ""
+}
+
+// stringValues returns the attribute key refers to as strings, one per list element.
+func (u FPUser) stringValues(key string) []string {
+	v, ok := u.lookup(key)
+	if !ok {
+		return nil
+	}
+	if list, ok := v.([]string); ok {
+		return list
+	}
+	return []string{formatAttr(v)}
+}
+
+// numberValues returns the attribute as numbers, skipping values which are not
+// numbers. Numbers have float32 precision, like the condition objects.
+func (u FPUser) numberValues(key string) []float64 {
+	v, ok := u.lookup(key)
+	if !ok {
+		return nil
+	}
+	if f, ok := v.(float64); ok {
+		return []float64{float64(float32(f))}
+	}
+	var numbers []float64
+	for _, s := range u.stringValues(key) {
+		if f, err := strconv.ParseFloat(s, 32); err == nil {
+			numbers = append(numbers, f)
+		}
+	}
+	return numbers
+}
+
+// datetimeValues returns the attribute as datetimes, skipping values which
+// are not datetimes. Numbers and strings are parsed as by parseDatetime.
+func (u FPUser) datetimeValues(key string) []time.Time {
+	v, ok := u.lookup(key)
+	if !ok {
+		return nil
+	}
+	switch value := v.(type) {
+	case time.Time:
+		return []time.Time{value}
+	case float64:
+		return []time.Time{timestampTime(int64(value))}
+	}
+	var datetimes []time.Time
+	for _, s := range u.stringValues(key) {
+		if d, err := parseDatetime(s); err == nil {
+			datetimes = append(datetimes, d)
+		}
+	}
+	return datetimes
+}
+
+// NewUserFromMap creates a user with attrs as attributes. Values may be
+// strings, numbers, bools, time.Time or lists of strings.
+func NewUserFromMap(attrs map[string]interface{}) (FPUser, error) {
+	user := NewUser()
+	for k, v := range attrs {
+		value, err := attrValue(reflect.ValueOf(v))
+		if err != nil {
+			return FPUser{}, fmt.Errorf("attribute %s: %w", k, err)
+		}
+		if value != nil {
+			user = user.with(k, value, false)
+		}
+	}
+	return user, nil
+}
+
+// NewUserFromStruct creates a user from the fields of a struct, or pointer to
+// struct, tagged with `featureprobe:"name"`. The "key" option makes a string
+// field the StableRollout key and the "private" option sets the attribute
+// with WithPrivate, e.g. `featureprobe:"email,private"`. Nil pointers are
+// skipped, other field types are those accepted by NewUserFromMap.
+func NewUserFromStruct(v interface{}) (FPUser, error) {
+	rv := reflect.ValueOf(v)
+	for rv.Kind() == reflect.Ptr && !rv.IsNil() {
+		rv = rv.Elem()
+	}
+	if rv.Kind() != reflect.Struct {
+		return FPUser{}, fmt.Errorf("%T is not a struct", v)
+	}
+
+	user := NewUser()
+	rt := rv.Type()
+	for i := 0; i < rt.NumField(); i++ {
+		field := rt.Field(i)
+		tag, ok := field.Tag.Lookup("featureprobe")
+		if !ok || tag == "-" || field.PkgPath != "" {
+			continue
+		}
+		options := strings.Split(tag, ",")
+		name := options[0]
+		if name == "" {
+			name = field.Name
+		}
+		value, err := attrValue(rv.Field(i))
+		if err != nil {
+			return FPUser{}, fmt.Errorf("field %s: %w", field.Name, err)
+		}
+		if value == nil {
+			continue
+		}
+		private := false
+		for _, option := range options[1:] {
+			switch option {
+			case "key":
+				key, ok := value.(string)
+				if !ok {
+					return FPUser{}, fmt.Errorf("field %s: key is not a string", field.Name)
+				}
+				user = user.StableRollout(key)
+			case "private":
+				private = true
+			}
+		}
+		user = user.with(name, value, private)
+	}
+	return user, nil
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// attrValue converts v to an attribute value, nil for nil values.
+func attrValue(v reflect.Value) (interface{}, error) {
+	for v.IsValid() && (v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface) {
+		if v.IsNil() {
+			return nil, nil
+		}
+		v = v.Elem()
+	}
+	if !v.IsValid() {
+		return nil, nil
+	}
+	if v.Type() == timeType {
+		return v.Interface().(time.Time), nil
+	}
+	switch v.Kind() {
+	case reflect.String:
+		return v.String(), nil
+	case reflect.Bool:
+		return v.Bool(), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(v.Int()), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(v.Uint()), nil
+	case reflect.Float32, reflect.Float64:
+		return v.Float(), nil
+	case reflect.Slice, reflect.Array:
+		list := make([]string, 0, v.Len())
+		for i := 0; i < v.Len(); i++ {
+			e := v.Index(i)
+			for e.Kind() == reflect.Interface && !e.IsNil() {
+				e = e.Elem()
+			}
+			if e.Kind() != reflect.String {
+				return nil, fmt.Errorf("unsupported list element type %s", e.Type())
+			}
+			list = append(list, e.String())
+		}
+		return list, nil
 	}
+	return nil, fmt.Errorf("unsupported type %s", v.Type())
 }
@@ -4,11 +4,12 @@ import (
 	"github.com/stretchr/testify/assert"
 	"sync"
 	"testing"
+	"time"
 )
 
 func TestFPUser(t *testing.T) {
 	var user = NewUser().StableRollout("uniqueUserKey")
-	user.With("city", "1").With("os", "linux")
+	user = user.With("city", "1").With("os", "linux")
 	assert.Equal(t, "1", user.Get("city"))
 	assert.Equal(t, 2, len(user.GetAll()))
 	assert.Equal(t, "uniqueUserKey", user.Key())
@@ -16,7 +17,36 @@ func TestFPUser(t *testing.T) {
 
 func TestAutoGenerateUserKey(t *testing.T) {
 	var user = NewUser()
-	assert.Equal(t, 19, len(user.Key()))
+	key := user.Key()
+	assert.Equal(t, 36, len(key))
+	assert.Equal(t, key, user.Key())
+	assert.True(t, user.Anonymous())
+	assert.NotEqual(t, key, NewUser().Key())
+
+	// users derived from a shared anonymous base are different users
+	derived := user.With("city", "1")
+	assert.NotEqual(t, key, derived.Key())
+	assert.Equal(t, derived.Key(), derived.Key())
+	assert.NotEqual(t, user.With("city", "2").Key(), derived.Key())
+
+	user = user.StableRollout("uniqueUserKey")
+	assert.Equal(t, "uniqueUserKey", user.Key())
+	assert.False(t, user.Anonymous())
+}
+
+func TestZeroValueUserKey(t *testing.T) {
+	var user FPUser
+	assert.Equal(t, 36, len(user.Key()))
+	assert.True(t, user.Anonymous())
+
+	pinned := user.withAnonymousKey()
+	assert.Equal(t, pinned.Key(), pinned.Key())
+	assert.Equal(t, pinned.Key(), pinned.at(time.Now()).Key())
+
+	withContext := NewUser().StableRollout("user").WithContext("device", FPUser{})
+	keys := withContext.ContextKeys()
+	assert.Equal(t, 36, len(keys["device"]))
+	assert.Equal(t, keys, withContext.ContextKeys())
 }
 
 func TestCurrentWriteUserAttr(t *testing.T) {
@@ -33,3 +63,176 @@ func TestCurrentWriteUserAttr(t *testing.T) {
 
 	wg.Wait()
 }
+
+func TestTypedUserAttr(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	groups := []string{"beta", "staff"}
+	var user = NewUser().
+		With("city", "1").
+		WithNumber("age", 18.5).
+		WithBool("vip", true).
+		WithTime("signup", now).
+		WithList("groups", groups)
+	groups[0] = "changed"
+
+	value, ok := user.GetValue("age")
+	assert.True(t, ok)
+	assert.Equal(t, 18.5, value)
+	value, _ = user.GetValue("signup")
+	assert.Equal(t, now, value)
+	value, _ = user.GetValue("groups")
+	assert.Equal(t, []string{"beta", "staff"}, value)
+	_, ok = user.GetValue("not_exist")
+	assert.False(t, ok)
+
+	assert.Equal(t, "1", user.Get("city"))
+	assert.Equal(t, "18.5", user.Get("age"))
+	assert.Equal(t, "true", user.Get("vip"))
+	assert.Equal(t, "1700000000", user.Get("signup"))
+	assert.Equal(t, "beta,staff", user.Get("groups"))
+	assert.Equal(t, 5, len(user.GetAll()))
+}
+
+func TestUserContexts(t *testing.T) {
+	organization := NewUser().StableRollout("org1").With("plan", "pro")
+	var user = NewUser().StableRollout("user1").WithContext("organization", organization)
+
+	context, ok := user.Context("organization")
+	assert.True(t, ok)
+	assert.Equal(t, "pro", context.Get("plan"))
+	_, ok = user.Context("device")
+	assert.False(t, ok)
+
+	assert.Equal(t, map[string]string{"organization": "org1"}, user.ContextKeys())
+	assert.Nil(t, NewUser().ContextKeys())
+
+	contexts := user.ToMap()["contexts"].(map[string]interface{})
+	assert.Equal(t, "org1", contexts["organization"].(map[string]interface{})["key"])
+}
+
+func TestRedactedUserMap(t *testing.T) {
+	device := NewUser().StableRollout("device1").With("os", "linux").WithPrivate("imei", "123")
+	var user = NewUser().StableRollout("user1").
+		With("city", "1").
+		With("email", "a@b.c").
+		WithPrivate("phone", "555").
+		WithContext("device", device)
+
+	m, redacted := user.redactedMap([]string{"email", "device.os"}, false)
+	assert.Equal(t, []string{"device.imei", "device.os", "email", "phone"}, redacted)
+	assert.Equal(t, "user1", m["key"])
+	assert.Equal(t, map[string]string{"city": "1"}, m["attrs"])
+	deviceMap := m["contexts"].(map[string]interface{})["device"].(map[string]interface{})
+	assert.Equal(t, "device1", deviceMap["key"])
+	assert.Equal(t, map[string]string{}, deviceMap["attrs"])
+
+	m, redacted = user.redactedMap(nil, true)
+	assert.Equal(t, []string{"city", "device.imei", "device.os", "email", "phone"}, redacted)
+	assert.Equal(t, map[string]string{}, m["attrs"])
+
+	m, redacted = NewUser().With("city", "1").redactedMap(nil, false)
+	assert.Nil(t, redacted)
+	assert.Equal(t, map[string]string{"city": "1"}, m["attrs"])
+
+	assert.Equal(t, "555", user.Get("phone"))
+	assert.Equal(t, 3, len(user.ToMap()["attrs"].(map[string]string)))
+}
+
+func TestUserImmutable(t *testing.T) {
+	base := NewUser().StableRollout("key").With("os", "linux")
+	a := base.With("city", "1")
+	b := base.With("city", "2").WithPrivate("os", "mac")
+
+	assert.Equal(t, "1", a.Get("city"))
+	assert.Equal(t, "2", b.Get("city"))
+	assert.False(t, base.ContainAttr("city"))
+	assert.Equal(t, "linux", a.Get("os"))
+	_, redacted := a.redactedMap(nil, false)
+	assert.Nil(t, redacted)
+	_, redacted = b.redactedMap(nil, false)
+	assert.Equal(t, []string{"os"}, redacted)
+	_, redacted = b.With("os", "linux").redactedMap(nil, false)
+	assert.Nil(t, redacted)
+
+	withOrg := base.WithContext("organization", NewUser().StableRollout("org1"))
+	_, ok := base.Context("organization")
+	assert.False(t, ok)
+	_, ok = withOrg.Context("organization")
+	assert.True(t, ok)
+}
+
+func TestUserClone(t *testing.T) {
+	user := NewUser().With("city", "1").WithList("groups", []string{"beta"}).
+		WithContext("device", NewUser().StableRollout("device1"))
+	clone := user.Clone()
+
+	assert.Equal(t, user.Key(), clone.Key())
+	assert.Equal(t, user.GetAll(), clone.GetAll())
+	assert.Equal(t, user.ContextKeys(), clone.ContextKeys())
+
+	clone.attrs["groups"].([]string)[0] = "changed"
+	assert.Equal(t, "beta", user.Get("groups"))
+}
+
+func TestNewUserFromMap(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	user, err := NewUserFromMap(map[string]interface{}{
+		"city":   "1",
+		"age":    18,
+		"score":  float32(1.5),
+		"vip":    true,
+		"signup": now,
+		"groups": []interface{}{"beta", "staff"},
+		"none":   nil,
+	})
+	assert.Nil(t, err)
+	assert.True(t, user.Anonymous())
+	value, _ := user.GetValue("age")
+	assert.Equal(t, 18.0, value)
+	value, _ = user.GetValue("score")
+	assert.Equal(t, 1.5, value)
+	value, _ = user.GetValue("vip")
+	assert.Equal(t, true, value)
+	value, _ = user.GetValue("signup")
+	assert.Equal(t, now, value)
+	value, _ = user.GetValue("groups")
+	assert.Equal(t, []string{"beta", "staff"}, value)
+	assert.False(t, user.ContainAttr("none"))
+
+	_, err = NewUserFromMap(map[string]interface{}{"data": map[string]string{}})
+	assert.NotNil(t, err)
+	_, err = NewUserFromMap(map[string]interface{}{"ids": []int{1}})
+	assert.NotNil(t, err)
+}
+
+func TestNewUserFromStruct(t *testing.T) {
+	type account struct {
+		ID       string   `featureprobe:"id,key"`
+		Email    string   `featureprobe:"email,private"`
+		Age      int      `featureprobe:"age"`
+		Country  *string  `featureprobe:"country"`
+		Groups   []string `featureprobe:""`
+		Ignored  string   `featureprobe:"-"`
+		Untagged string
+		secret   string
+	}
+	user, err := NewUserFromStruct(&account{ID: "u1", Email: "a@b.c", Age: 30,
+		Groups: []string{"beta"}, Ignored: "x", Untagged: "y", secret: "z"})
+	assert.Nil(t, err)
+	assert.Equal(t, "u1", user.Key())
+	assert.Equal(t, "u1", user.Get("id"))
+	assert.Equal(t, "a@b.c", user.Get("email"))
+	assert.Equal(t, "30", user.Get("age"))
+	assert.Equal(t, "beta", user.Get("Groups"))
+	assert.False(t, user.ContainAttr("country"))
+	assert.Equal(t, 4, len(user.GetAll()))
+	_, redacted := user.redactedMap(nil, false)
+	assert.Equal(t, []string{"email"}, redacted)
+
+	_, err = NewUserFromStruct("not a struct")
+	assert.NotNil(t, err)
+	_, err = NewUserFromStruct(struct {
+		ID int `featureprobe:"id,key"`
+	}{ID: 1})
+	assert.NotNil(t, err)
+}
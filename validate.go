@@ -0,0 +1,442 @@
+package featureprobe
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// conditionPredicates lists the predicates supported by each condition type.
+var conditionPredicates = map[string][]string{
+	"string": {"is one of", "starts with", "ends with", "contains", "matches regex",
+		"is not any of", "does not start with", "does not end with", "does not contain", "does not match regex"},
+	"segment":  {"is in", "is not in"},
+	"datetime": {"after", "before", "between", "on days of week", "between times of day"},
+	"semver":   {"=", "!=", ">", ">=", "<", "<=", "satisfies", "does not satisfy"},
+	"number":   {"=", "!=", ">", ">=", "<", "<="},
+	"ip":       {"in cidr", "not in cidr"},
+	"list":     {"contains any", "contains all"},
+	"boolean":  {"is true", "is false"},
+}
+
+// ValidationProblem describes a malformed part of a toggle or segment, Path
+// locates it, e.g. "rules[0].conditions[1].objects[2]".
+type ValidationProblem struct {
+	Path    string
+	Message string
+}
+
+// ValidationReport lists the problems found in the toggles and segments
+// loaded into a Repository, keyed by toggle key and segment unique id.
+type ValidationReport struct {
+	Toggles  map[string][]ValidationProblem
+	Segments map[string][]ValidationProblem
+}
+
+func (r ValidationReport) Empty() bool {
+	return len(r.Toggles) == 0 && len(r.Segments) == 0
+}
+
+func (r ValidationReport) String() string {
+	var lines []string
+	for _, key := range sortedProblemKeys(r.Toggles) {
+		for _, p := range r.Toggles[key] {
+			lines = append(lines, fmt.Sprintf("toggle %s %s: %s", key, p.Path, p.Message))
+		}
+	}
+	for _, key := range sortedProblemKeys(r.Segments) {
+		for _, p := range r.Segments[key] {
+			lines = append(lines, fmt.Sprintf("segment %s %s: %s", key, p.Path, p.Message))
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+func sortedProblemKeys(problems map[string][]ValidationProblem) []string {
+	keys := make([]string, 0, len(problems))
+	for key := range problems {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// ValidateRepositoryData checks the toggles and segments of data for problems
+// which would make evaluation silently fail.
+func ValidateRepositoryData(data RepositoryData) ValidationReport {
+	report := ValidationReport{
+		Toggles:  map[string][]ValidationProblem{},
+		Segments: map[string][]ValidationProblem{},
+	}
+	for key, toggle := range data.Toggles {
+		if problems := validateToggle(toggle, data); len(problems) > 0 {
+			report.Toggles[key] = problems
+		}
+	}
+	cycles := findPrerequisiteCycles(data.Toggles)
+	for _, cycle := range cycles {
+		for _, key := range cycle[1:] {
+			report.Toggles[key] = append(report.Toggles[key], ValidationProblem{Path: "prerequisites",
+				Message: "prerequisite cycle " + formatPrerequisiteCycle(cycle)})
+		}
+	}
+	for key, overlaps := range findLayerOverlaps(data.Toggles) {
+		report.Toggles[key] = append(report.Toggles[key], overlaps...)
+	}
+	for key, mismatches := range findSaltMismatches("layer", bucketShareSalts(data.Toggles, splitLayer)) {
+		report.Toggles[key] = append(report.Toggles[key], mismatches...)
+	}
+	for key, mismatches := range findSaltMismatches("holdout", bucketShareSalts(data.Toggles, splitHoldout)) {
+		report.Toggles[key] = append(report.Toggles[key], mismatches...)
+	}
+	for key, segment := range data.Segments {
+		if problems := validateRules(segment.Rules, data, nil); len(problems) > 0 {
+			report.Segments[key] = problems
+		}
+	}
+	for _, cycle := range findSegmentCycles(data.Segments) {
+		for _, key := range cycle[1:] {
+			report.Segments[key] = append(report.Segments[key], ValidationProblem{Path: "rules",
+				Message: "segment cycle " + strings.Join(cycle, " -> ")})
+		}
+	}
+	return report
+}
+
+// findSegmentCycles returns the cycles of segments referring to each other in
+// their rules, each one starts and ends with the same segment key.
+func findSegmentCycles(segments map[string]Segment) [][]string {
+	keys := make([]string, 0, len(segments))
+	for key := range segments {
+		keys = append(keys, key)
+	}
+	return findCycles(keys, func(key string) []string {
+		var edges []string
+		for _, rule := range segments[key].Rules {
+			for _, c := range rule.Conditions {
+				if c.Type != "segment" {
+					continue
+				}
+				for _, o := range c.Objects {
+					if _, ok := segments[o]; ok {
+						edges = append(edges, o)
+					}
+				}
+			}
+		}
+		return edges
+	})
+}
+
+func validateToggle(toggle Toggle, data RepositoryData) []ValidationProblem {
+	var problems []ValidationProblem
+	add := func(path string, format string, a ...interface{}) {
+		problems = append(problems, ValidationProblem{Path: path, Message: fmt.Sprintf(format, a...)})
+	}
+
+	variations := len(toggle.Variations)
+	for _, p := range validateServe(toggle.DefaultServe, variations) {
+		add("defaultServe"+p.Path, p.Message)
+	}
+	for _, p := range validateServe(toggle.DisabledServe, variations) {
+		add("disabledServe"+p.Path, p.Message)
+	}
+	for i, prerequisite := range toggle.Prerequisites {
+		if _, ok := data.Toggles[prerequisite.Key]; !ok {
+			add(fmt.Sprintf("prerequisites[%d]", i), "prerequisite toggle %s not exist", prerequisite.Key)
+		}
+	}
+	for i, target := range toggle.Targets {
+		if target.Variation < 0 || target.Variation >= variations {
+			add(fmt.Sprintf("targets[%d].variation", i), "index %d overflow, variations count is %d",
+				target.Variation, variations)
+		}
+	}
+	return append(problems, validateRules(toggle.Rules, data, &variations)...)
+}
+
+// validateRules checks rules and, when variations is not nil, their serves.
+func validateRules(rules []Rule, data RepositoryData, variations *int) []ValidationProblem {
+	var problems []ValidationProblem
+	for i, rule := range rules {
+		path := fmt.Sprintf("rules[%d]", i)
+		if variations != nil {
+			for _, p := range validateServe(rule.Serve, *variations) {
+				problems = append(problems, ValidationProblem{Path: path + ".serve" + p.Path, Message: p.Message})
+			}
+		}
+		for j, condition := range rule.Conditions {
+			for _, p := range validateCondition(condition, data) {
+				p.Path = fmt.Sprintf("%s.conditions[%d]%s", path, j, p.Path)
+				problems = append(problems, p)
+			}
+		}
+	}
+	return problems
+}
+
+func validateServe(serve Serve, variations int) []ValidationProblem {
+	if serve.Select != nil {
+		if *serve.Select < 0 || *serve.Select >= variations {
+			return []ValidationProblem{{Path: ".select",
+				Message: fmt.Sprintf("index %d overflow, variations count is %d", *serve.Select, variations)}}
+		}
+		return nil
+	}
+	if serve.Split == nil {
+		return []ValidationProblem{{Message: "serve has neither select nor split"}}
+	}
+	var problems []ValidationProblem
+	if len(serve.Split.Distribution) > variations {
+		problems = append(problems, ValidationProblem{Path: ".split.distribution",
+			Message: fmt.Sprintf("%d distributions for %d variations", len(serve.Split.Distribution), variations)})
+	}
+	for i, ranges := range serve.Split.Distribution {
+		for j, r := range ranges {
+			if r.Lower < 0 || r.Upper > 10000 || r.Lower > r.Upper {
+				problems = append(problems, ValidationProblem{
+					Path:    fmt.Sprintf(".split.distribution[%d][%d]", i, j),
+					Message: fmt.Sprintf("invalid range [%d, %d]", r.Lower, r.Upper)})
+			}
+		}
+	}
+	if serve.Split.Holdout != nil {
+		problems = append(problems, validateBucketShare(".split.holdout", serve.Split.Holdout, variations)...)
+	}
+	if serve.Split.Layer != nil {
+		problems = append(problems, validateBucketShare(".split.layer", serve.Split.Layer, variations)...)
+	}
+	return problems
+}
+
+// validateBucketShare checks the holdout or layer of a split at path.
+func validateBucketShare(path string, share *BucketShare, variations int) []ValidationProblem {
+	var problems []ValidationProblem
+	if share.Variation < 0 || share.Variation >= variations {
+		problems = append(problems, ValidationProblem{Path: path + ".variation",
+			Message: fmt.Sprintf("index %d overflow, variations count is %d", share.Variation, variations)})
+	}
+	for i, r := range share.Ranges {
+		if r.Lower < 0 || r.Upper > 10000 || r.Lower > r.Upper {
+			problems = append(problems, ValidationProblem{Path: fmt.Sprintf("%s.ranges[%d]", path, i),
+				Message: fmt.Sprintf("invalid range [%d, %d]", r.Lower, r.Upper)})
+		}
+	}
+	return problems
+}
+
+func splitHoldout(split *Split) *BucketShare {
+	return split.Holdout
+}
+
+func splitLayer(split *Split) *BucketShare {
+	return split.Layer
+}
+
+// malformedCondition returns an ErrMalformedFlag error for the first problem
+// of c, nil when c is well formed.
+func malformedCondition(c Condition) error {
+	problems := conditionProblems(c)
+	if len(problems) == 0 {
+		return nil
+	}
+	return fmt.Errorf("%w: condition%s: %s", ErrMalformedFlag, problems[0].Path, problems[0].Message)
+}
+
+// toggleSplits returns the splits of the serves of toggle.
+func toggleSplits(toggle Toggle) []*Split {
+	var splits []*Split
+	add := func(serve Serve) {
+		if serve.Split != nil {
+			splits = append(splits, serve.Split)
+		}
+	}
+	add(toggle.DefaultServe)
+	add(toggle.DisabledServe)
+	for _, rule := range toggle.Rules {
+		add(rule.Serve)
+	}
+	return splits
+}
+
+// toggleBucketShares returns the holdouts or layers, picked by share, used by
+// the splits of toggle.
+func toggleBucketShares(toggle Toggle, share func(*Split) *BucketShare) []*BucketShare {
+	var shares []*BucketShare
+	for _, split := range toggleSplits(toggle) {
+		if s := share(split); s != nil {
+			shares = append(shares, s)
+		}
+	}
+	return shares
+}
+
+// sharedSalt is the effective salt of a layer or holdout used by a toggle.
+type sharedSalt struct {
+	toggle string
+	key    string
+	salt   string
+}
+
+func sortedToggleKeys(toggles map[string]Toggle) []string {
+	keys := make([]string, 0, len(toggles))
+	for key := range toggles {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// bucketShareSalts returns the effective salts of the holdouts or layers,
+// picked by share, of toggles in toggle key order.
+func bucketShareSalts(toggles map[string]Toggle, share func(*Split) *BucketShare) []sharedSalt {
+	var salts []sharedSalt
+	for _, key := range sortedToggleKeys(toggles) {
+		for _, s := range toggleBucketShares(toggles[key], share) {
+			salts = append(salts, sharedSalt{toggle: key, key: s.Key, salt: s.salt()})
+		}
+	}
+	return salts
+}
+
+// findSaltMismatches returns, by toggle key, the problems of the layers or
+// holdouts, according to kind, whose salt differs from the salt the first
+// toggle uses with the same key: their users would not share a bucket space.
+func findSaltMismatches(kind string, salts []sharedSalt) map[string][]ValidationProblem {
+	first := map[string]sharedSalt{}
+	problems := map[string][]ValidationProblem{}
+	for _, s := range salts {
+		f, ok := first[s.key]
+		if !ok {
+			first[s.key] = s
+			continue
+		}
+		if f.salt != s.salt {
+			problems[s.toggle] = append(problems[s.toggle], ValidationProblem{Path: kind,
+				Message: fmt.Sprintf("%s %s salt %q differs from salt %q of toggle %s", kind, s.key, s.salt, f.salt, f.toggle)})
+		}
+	}
+	return problems
+}
+
+// findLayerOverlaps returns, by toggle key, the problems of the layer ranges
+// of toggles overlapping the ranges of another toggle of the same layer.
+func findLayerOverlaps(toggles map[string]Toggle) map[string][]ValidationProblem {
+	type layerRange struct {
+		toggle string
+		r      Range
+	}
+	layers := map[string][]layerRange{}
+	for _, key := range sortedToggleKeys(toggles) {
+		for _, layer := range toggleBucketShares(toggles[key], splitLayer) {
+			for _, r := range layer.Ranges {
+				layers[layer.Key] = append(layers[layer.Key], layerRange{toggle: key, r: r})
+			}
+		}
+	}
+
+	problems := map[string][]ValidationProblem{}
+	overlap := func(layerKey string, x, y layerRange) {
+		problems[x.toggle] = append(problems[x.toggle], ValidationProblem{Path: "layer",
+			Message: fmt.Sprintf("layer %s range [%d, %d] overlaps toggle %s", layerKey, x.r.Lower, x.r.Upper, y.toggle)})
+	}
+	for layerKey, ranges := range layers {
+		for i, a := range ranges {
+			for _, b := range ranges[i+1:] {
+				if a.toggle == b.toggle || a.r.Upper <= b.r.Lower || b.r.Upper <= a.r.Lower {
+					continue
+				}
+				overlap(layerKey, a, b)
+				overlap(layerKey, b, a)
+			}
+		}
+	}
+	return problems
+}
+
+func validateCondition(c Condition, data RepositoryData) []ValidationProblem {
+	problems := conditionProblems(c)
+	if len(problems) > 0 || c.Type != "segment" {
+		return problems
+	}
+	for i, o := range c.Objects {
+		if _, ok := data.Segments[o]; !ok {
+			problems = append(problems, ValidationProblem{Path: fmt.Sprintf(".objects[%d]", i),
+				Message: fmt.Sprintf("segment %s not exist", o)})
+		}
+	}
+	return problems
+}
+
+// conditionProblems returns the problems of c which make it malformed
+// whatever the segments it refers to.
+func conditionProblems(c Condition) []ValidationProblem {
+	predicates, ok := conditionPredicates[c.Type]
+	if !ok {
+		return []ValidationProblem{{Path: ".type", Message: fmt.Sprintf("unknown condition type %q", c.Type)}}
+	}
+	known := false
+	for _, p := range predicates {
+		if p == c.Predicate {
+			known = true
+			break
+		}
+	}
+	if !known {
+		return []ValidationProblem{{Path: ".predicate",
+			Message: fmt.Sprintf("unknown %s predicate %q", c.Type, c.Predicate)}}
+	}
+
+	var problems []ValidationProblem
+	if strings.Trim(c.RegexFlags, "imsU") != "" {
+		problems = append(problems, ValidationProblem{Path: ".regexFlags",
+			Message: fmt.Sprintf("unknown regex flags %q", c.RegexFlags)})
+	}
+	if c.Type == "semver" && c.Prerelease != "" && c.Prerelease != "include" && c.Prerelease != "exclude" {
+		problems = append(problems, ValidationProblem{Path: ".prerelease",
+			Message: fmt.Sprintf("unknown prerelease policy %q", c.Prerelease)})
+	}
+	if c.Type == "datetime" {
+		if _, err := loadLocation(c.Timezone); err != nil {
+			problems = append(problems, ValidationProblem{Path: ".timezone", Message: err.Error()})
+		}
+		if (c.Predicate == "between" || c.Predicate == "between times of day") && len(c.Objects)%2 != 0 {
+			problems = append(problems, ValidationProblem{Path: ".objects",
+				Message: fmt.Sprintf("%s needs pairs of objects, got %d objects", c.Predicate, len(c.Objects))})
+		}
+	}
+	for i, o := range c.Objects {
+		var err error
+		switch c.Type {
+		case "string":
+			if c.Predicate == "matches regex" || c.Predicate == "does not match regex" {
+				_, err = regexp.Compile(c.regexPattern(o))
+			}
+		case "datetime":
+			switch c.Predicate {
+			case "on days of week":
+				_, err = parseWeekday(o)
+			case "between times of day":
+				_, err = parseClock(o)
+			default:
+				_, err = parseDatetime(o)
+			}
+		case "semver":
+			if c.Predicate == "satisfies" || c.Predicate == "does not satisfy" {
+				_, err = c.parseConstraints(o)
+			} else {
+				_, err = c.parseVersion(o)
+			}
+		case "number":
+			_, err = strconv.ParseFloat(o, 32)
+		case "ip":
+			_, err = parseIpPrefix(o)
+		}
+		if err != nil {
+			problems = append(problems, ValidationProblem{Path: fmt.Sprintf(".objects[%d]", i), Message: err.Error()})
+		}
+	}
+	return problems
+}
@@ -0,0 +1,306 @@
+package featureprobe
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const malformedRepoJson = `
+{
+	"segments": {
+		"segment_1": {
+			"key": "segment_1",
+			"uniqueId": "segment_1",
+			"version": 1,
+			"rules": [
+				{
+					"conditions": [
+						{
+							"type": "number",
+							"subject": "age",
+							"predicate": ">",
+							"objects": ["18", "eighteen"]
+						}
+					]
+				}
+			]
+		}
+	},
+	"toggles": {
+		"malformed_toggle": {
+			"key": "malformed_toggle",
+			"enabled": true,
+			"version": 1,
+			"disabledServe": {
+				"select": 0
+			},
+			"defaultServe": {},
+			"rules": [
+				{
+					"serve": {
+						"select": 3
+					},
+					"conditions": [
+						{
+							"type": "string",
+							"subject": "name",
+							"predicate": "matches regex",
+							"objects": ["[invalid"]
+						},
+						{
+							"type": "location",
+							"subject": "city",
+							"predicate": "near",
+							"objects": []
+						},
+						{
+							"type": "segment",
+							"predicate": "is in",
+							"objects": ["segment_1", "segment_2"]
+						}
+					]
+				}
+			],
+			"prerequisites": [
+				{
+					"key": "not_exist_toggle",
+					"value": true
+				}
+			],
+			"variations": [true, false]
+		},
+		"valid_toggle": {
+			"key": "valid_toggle",
+			"enabled": true,
+			"version": 1,
+			"disabledServe": {
+				"select": 0
+			},
+			"defaultServe": {
+				"split": {
+					"distribution": [[[0, 5000]], [[5000, 10000]]]
+				}
+			},
+			"rules": [],
+			"variations": [true, false]
+		}
+	}
+}`
+
+func TestValidateRepositoryData(t *testing.T) {
+	repoData := RepositoryData{}
+	err := json.Unmarshal([]byte(malformedRepoJson), &repoData)
+	assert.Equal(t, nil, err)
+
+	report := ValidateRepositoryData(repoData)
+	assert.False(t, report.Empty())
+	assert.NotContains(t, report.Toggles, "valid_toggle")
+
+	paths := map[string]string{}
+	for _, p := range report.Toggles["malformed_toggle"] {
+		paths[p.Path] = p.Message
+	}
+	assert.Equal(t, "serve has neither select nor split", paths["defaultServe"])
+	assert.Contains(t, paths["rules[0].serve.select"], "overflow")
+	assert.Contains(t, paths, "rules[0].conditions[0].objects[0]")
+	assert.Contains(t, paths["rules[0].conditions[1].type"], "location")
+	assert.Equal(t, "segment segment_2 not exist", paths["rules[0].conditions[2].objects[1]"])
+	assert.Contains(t, paths["prerequisites[0]"], "not_exist_toggle")
+	assert.Equal(t, 6, len(paths))
+
+	segmentProblems := report.Segments["segment_1"]
+	assert.Equal(t, 1, len(segmentProblems))
+	assert.Equal(t, "rules[0].conditions[0].objects[1]", segmentProblems[0].Path)
+}
+
+func TestValidateNewConditionTypes(t *testing.T) {
+	conditions := []Condition{
+		{Type: "ip", Subject: "ip", Predicate: "in cidr", Objects: []string{"10.0.0.0/8", "::1", "10.0.0.0/33", "abc"}},
+		{Type: "ip", Subject: "ip", Predicate: "in range", Objects: []string{}},
+		{Type: "list", Subject: "roles", Predicate: "contains all", Objects: []string{"admin"}},
+		{Type: "boolean", Subject: "vip", Predicate: "is false", Objects: []string{}},
+	}
+
+	problems := validateCondition(conditions[0], RepositoryData{})
+	assert.Equal(t, 2, len(problems))
+	assert.Equal(t, ".objects[2]", problems[0].Path)
+	assert.Equal(t, ".objects[3]", problems[1].Path)
+
+	problems = validateCondition(conditions[1], RepositoryData{})
+	assert.Equal(t, 1, len(problems))
+	assert.Equal(t, ".predicate", problems[0].Path)
+
+	assert.Empty(t, validateCondition(conditions[2], RepositoryData{}))
+	assert.Empty(t, validateCondition(conditions[3], RepositoryData{}))
+}
+
+func TestValidateRegexFlags(t *testing.T) {
+	condition := Condition{Type: "string", Subject: "name", Predicate: "matches regex",
+		Objects: []string{"^a"}, RegexFlags: "im"}
+	assert.Empty(t, validateCondition(condition, RepositoryData{}))
+
+	condition.RegexFlags = "x"
+	problems := validateCondition(condition, RepositoryData{})
+	assert.Equal(t, 2, len(problems))
+	assert.Equal(t, ".regexFlags", problems[0].Path)
+	assert.Equal(t, ".objects[0]", problems[1].Path)
+}
+
+func TestValidateSegmentCycles(t *testing.T) {
+	data := RepositoryData{Segments: nestedSegments()}
+	report := ValidateRepositoryData(data)
+
+	assert.Equal(t, 2, len(report.Segments))
+	assert.Equal(t, []ValidationProblem{{Path: "rules", Message: "segment cycle loop_a -> loop_b -> loop_a"}},
+		report.Segments["loop_b"])
+	assert.Equal(t, "segment cycle loop_a -> loop_b -> loop_a", report.Segments["loop_a"][0].Message)
+}
+
+func TestValidateHoldout(t *testing.T) {
+	toggle := setupExperimentToggle("checkout", &Holdout{Key: "q4_holdout",
+		Ranges: []Range{{Lower: 0, Upper: 500}, {Lower: 9000, Upper: 10001}}, Variation: 3})
+	problems := validateToggle(toggle, RepositoryData{})
+	assert.Equal(t, 2, len(problems))
+	assert.Equal(t, "defaultServe.split.holdout.variation", problems[0].Path)
+	assert.Equal(t, "defaultServe.split.holdout.ranges[1]", problems[1].Path)
+
+	toggle = setupExperimentToggle("checkout", nil)
+	toggle.DefaultServe.Split.Layer = &Layer{Key: "checkout_layer",
+		Ranges: []Range{{Lower: 0, Upper: 500}, {Lower: 9000, Upper: 10001}}, Variation: 3}
+	problems = validateToggle(toggle, RepositoryData{})
+	assert.Equal(t, 2, len(problems))
+	assert.Equal(t, "defaultServe.split.layer.variation", problems[0].Path)
+	assert.Equal(t, "defaultServe.split.layer.ranges[1]", problems[1].Path)
+}
+
+func TestValidateLayerOverlaps(t *testing.T) {
+	data := RepositoryData{Toggles: map[string]Toggle{
+		"button_color": setupLayerToggle("button_color", Range{Lower: 0, Upper: 3000}),
+		"button_text":  setupLayerToggle("button_text", Range{Lower: 2000, Upper: 6000}),
+		"price":        setupLayerToggle("price", Range{Lower: 6000, Upper: 10000}),
+	}}
+	report := ValidateRepositoryData(data)
+
+	assert.Equal(t, 2, len(report.Toggles))
+	assert.Equal(t, []ValidationProblem{{Path: "layer",
+		Message: "layer checkout_layer range [0, 3000] overlaps toggle button_text"}}, report.Toggles["button_color"])
+	assert.Equal(t, []ValidationProblem{{Path: "layer",
+		Message: "layer checkout_layer range [2000, 6000] overlaps toggle button_color"}}, report.Toggles["button_text"])
+}
+
+func TestValidateLayerSalts(t *testing.T) {
+	salted := setupLayerToggle("button_text", Range{Lower: 3000, Upper: 6000})
+	salted.DefaultServe.Split.Layer.Salt = "other_salt"
+	keyed := setupLayerToggle("price", Range{Lower: 6000, Upper: 10000})
+	keyed.DefaultServe.Split.Layer.Salt = "checkout_layer"
+	data := RepositoryData{Toggles: map[string]Toggle{
+		"button_color": setupLayerToggle("button_color", Range{Lower: 0, Upper: 3000}),
+		"button_text":  salted,
+		"price":        keyed,
+	}}
+	report := ValidateRepositoryData(data)
+
+	assert.Equal(t, 1, len(report.Toggles))
+	assert.Equal(t, []ValidationProblem{{Path: "layer",
+		Message: `layer checkout_layer salt "other_salt" differs from salt "checkout_layer" of toggle button_color`}},
+		report.Toggles["button_text"])
+}
+
+func TestValidateHoldoutSalts(t *testing.T) {
+	ranges := []Range{{Lower: 0, Upper: 500}}
+	data := RepositoryData{Toggles: map[string]Toggle{
+		"checkout": setupExperimentToggle("checkout", &Holdout{Key: "q4_holdout", Ranges: ranges, Variation: 2}),
+		"search": setupExperimentToggle("search", &Holdout{Key: "q4_holdout", Salt: "q4_holdout", Ranges: ranges,
+			Variation: 2}),
+		"pricing": setupExperimentToggle("pricing", &Holdout{Key: "q4_holdout", Salt: "pricing", Ranges: ranges,
+			Variation: 2}),
+	}}
+	report := ValidateRepositoryData(data)
+
+	assert.Equal(t, 1, len(report.Toggles))
+	assert.Equal(t, []ValidationProblem{{Path: "holdout",
+		Message: `holdout q4_holdout salt "pricing" differs from salt "q4_holdout" of toggle checkout`}},
+		report.Toggles["pricing"])
+}
+
+func TestValidateSemverCondition(t *testing.T) {
+	condition := Condition{Type: "semver", Subject: "version", Predicate: "satisfies",
+		Objects: []string{"^1.2 || >=2.0.0-beta", "> banana"}}
+	problems := validateCondition(condition, RepositoryData{})
+	assert.Equal(t, 1, len(problems))
+	assert.Equal(t, ".objects[1]", problems[0].Path)
+
+	condition = Condition{Type: "semver", Subject: "version", Predicate: "=",
+		Objects: []string{"v1.2"}, StrictSemver: true, Prerelease: "maybe"}
+	problems = validateCondition(condition, RepositoryData{})
+	assert.Equal(t, 2, len(problems))
+	assert.Equal(t, ".prerelease", problems[0].Path)
+	assert.Equal(t, ".objects[0]", problems[1].Path)
+}
+
+func TestValidationReportFromClient(t *testing.T) {
+	repoData := RepositoryData{}
+	_ = json.Unmarshal([]byte(malformedRepoJson), &repoData)
+	repo := &Repository{}
+	repo.flush(repoData)
+	fp := FeatureProbe{Repo: repo, Config: FPConfig{MaxPrerequisitesDeep: 5}}
+
+	report := fp.ValidationReport()
+	assert.Contains(t, report.Toggles, "malformed_toggle")
+	assert.Contains(t, report.String(), "toggle malformed_toggle defaultServe: serve has neither select nor split")
+}
+
+func TestMalformedServe(t *testing.T) {
+	toggle := Toggle{
+		Key:           "malformed_toggle",
+		Enabled:       true,
+		DefaultServe:  Serve{},
+		DisabledServe: Serve{},
+		Variations:    []interface{}{true, false},
+	}
+	detail, err := toggle.evalDetail(NewUser(), nil, nil, false, 10)
+	assert.True(t, errors.Is(err, ErrMalformedFlag))
+	assert.Equal(t, false, detail.Value)
+	assert.Contains(t, detail.Reason, "malformed flag")
+}
+
+func TestMalformedConditions(t *testing.T) {
+	conditions := map[string]Condition{
+		"regex":  {Type: "string", Subject: "name", Predicate: "matches regex", Objects: []string{"(unclosed"}},
+		"number": {Type: "number", Subject: "price", Predicate: ">", Objects: []string{"ten"}},
+		"datetime": {Type: "datetime", Subject: "created", Predicate: "after",
+			Objects: []string{"yesterday"}},
+		"semver": {Type: "semver", Subject: "version", Predicate: ">=", Objects: []string{"one.two"}},
+		"type":   {Type: "color", Subject: "name", Predicate: "is one of", Objects: []string{"red"}},
+		"predicate": {Type: "string", Subject: "name", Predicate: "sounds like",
+			Objects: []string{"bob"}},
+	}
+	for name, condition := range conditions {
+		on, off := 0, 1
+		toggle := Toggle{
+			Key:           "malformed_toggle",
+			Enabled:       true,
+			Version:       1,
+			DefaultServe:  Serve{Select: &off},
+			DisabledServe: Serve{Select: &off},
+			Rules:         []Rule{{Serve: Serve{Select: &on}, Conditions: []Condition{condition}}},
+			Variations:    []interface{}{true, false},
+		}
+		user := NewUser().With("name", "bob").With("price", "12").With("created", "1700000000").
+			With("version", "1.2.0")
+
+		detail, err := toggle.evalDetail(user, nil, nil, false, 10)
+		assert.True(t, errors.Is(err, ErrMalformedFlag), name)
+		assert.Contains(t, detail.Reason, "malformed flag", name)
+
+		repo := &Repository{}
+		repo.flush(RepositoryData{Toggles: map[string]Toggle{toggle.Key: toggle}})
+		fp := FeatureProbe{Repo: repo, Config: FPConfig{MaxPrerequisitesDeep: 5}}
+		fpDetail := fp.BoolDetail(toggle.Key, user, true)
+		assert.True(t, fpDetail.Value, name)
+		assert.Contains(t, fpDetail.Reason, "malformed flag", name)
+	}
+}